@@ -0,0 +1,246 @@
+// The jobpack command runs the jobs of the Go workers on a Disco master, or
+// locally, and prints the content of jobpack files.
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+
+	"github.com/discoproject/goworker/jobpack"
+	"github.com/discoproject/goworker/jobutil"
+
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+)
+
+type Inputs []string
+
+func (i *Inputs) String() string {
+	return fmt.Sprint(*i)
+}
+func (i *Inputs) Set(value string) error {
+	if len(*i) > 0 {
+		return errors.New("Inputs already set")
+	}
+	for _, input := range strings.Split(value, ",") {
+		*i = append(*i, input)
+	}
+	return nil
+}
+
+// Files are the files added to the job home, the flag can be repeated.
+type Files []string
+
+func (f *Files) String() string {
+	return fmt.Sprint(*f)
+}
+func (f *Files) Set(value string) error {
+	*f = append(*f, strings.Split(value, ",")...)
+	return nil
+}
+
+// jobOptionFlags are the keys of the job options, by name of their flag.
+var jobOptionFlags = map[string]string{
+	"Name":        "prefix",
+	"Partitions":  "partitions",
+	"NrReduces":   "nr_reduces",
+	"SaveResults": "save_results",
+	"SaveInfo":    "save_info",
+	"MaxCores":    "scheduler.max_cores",
+	"ForceLocal":  "scheduler.force_local",
+	"ForceRemote": "scheduler.force_remote",
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "inspect" {
+		inspect(os.Args[2:])
+		return
+	}
+
+	var master string
+	var confFile string
+	var inputs Inputs
+	var worker string
+	var jobtype string
+	var local bool
+	var output string
+	var save string
+	var jobConf string
+	var files Files
+	var dataFile string
+	var params string
+
+	const (
+		defaultMaster  = "localhost"
+		masterUsage    = "The master node."
+		defaultConf    = "/etc/disco/settings.py"
+		confUsage      = "The setting file which contains disco settings"
+		defaultWorker  = ""
+		workerUsage    = "The worker directory, a .go file, or an executable"
+		defaultInputs  = ""
+		inputUsage     = "The comma separated list of inputs to the job."
+		defaultJobType = "mapreduce"
+		jobTypeUsage   = "type of the job (mapreduce or pipeline)"
+		localUsage     = "Run the job locally instead of posting it to the master"
+		defaultOutput  = "results"
+		outputUsage    = "The directory of the results of a local job"
+		saveUsage      = "Write the jobpack in this file instead of submitting it"
+		jobConfUsage   = "The JSON file of the job options, which override those of the worker"
+		filesUsage     = "The comma separated list of files and directories added to the job home"
+		dataUsage      = "The file of the jobdata of the job"
+		paramsUsage    = "The JSON params of the job, sent as its jobdata"
+	)
+	flag.StringVar(&master, "Master", "", masterUsage)
+	flag.StringVar(&master, "M", "", masterUsage)
+	flag.StringVar(&confFile, "Conf", defaultConf, confUsage)
+	flag.StringVar(&confFile, "C", defaultConf, confUsage)
+	flag.StringVar(&worker, "Worker", defaultWorker, workerUsage)
+	flag.StringVar(&worker, "W", defaultWorker, workerUsage)
+
+	flag.Var(&inputs, "Inputs", inputUsage)
+	flag.Var(&inputs, "I", inputUsage)
+
+	flag.StringVar(&jobtype, "Type", defaultJobType, jobTypeUsage)
+	flag.StringVar(&jobtype, "T", defaultJobType, jobTypeUsage)
+
+	flag.BoolVar(&local, "Local", false, localUsage)
+	flag.BoolVar(&local, "L", false, localUsage)
+	flag.StringVar(&output, "Output", defaultOutput, outputUsage)
+	flag.StringVar(&output, "O", defaultOutput, outputUsage)
+	flag.StringVar(&save, "Save", "", saveUsage)
+	flag.StringVar(&save, "S", "", saveUsage)
+
+	flag.StringVar(&jobConf, "JobConf", "", jobConfUsage)
+	flag.StringVar(&jobConf, "J", "", jobConfUsage)
+	flag.Var(&files, "Files", filesUsage)
+	flag.Var(&files, "F", filesUsage)
+	flag.StringVar(&dataFile, "Data", "", dataUsage)
+	flag.StringVar(&params, "Params", "", paramsUsage)
+	flag.String("Name", "", "The name of the job")
+	flag.Int("Partitions", 0, "The number of partitions of the map outputs")
+	flag.Int("NrReduces", 0, "The number of reduce tasks, the same as the partitions")
+	flag.Bool("SaveResults", false, "Save the results of the job in DDFS")
+	flag.String("SaveInfo", "", "Where the information of the job is saved")
+	flag.Int("MaxCores", 0, "The most tasks of the job run at once")
+	flag.Bool("ForceLocal", false, "Run the tasks on the nodes of their inputs")
+	flag.Bool("ForceRemote", false, "Run the tasks on other nodes than those of their inputs")
+
+	flag.Parse()
+
+	if worker == "" || len(inputs) == 0 {
+		fmt.Println("Usage: jobpack -W worker_dir -I input(s)")
+		fmt.Println("       jobpack inspect FILE...")
+		os.Exit(1)
+	}
+
+	// a local or saved job only needs the settings for its tag inputs
+	if err := jobutil.AddFile(confFile); err != nil && !local && save == "" {
+		jobutil.Check(err)
+	}
+	if master != "" {
+		jobutil.SetKeyValue("DISCO_MASTER_HOST", master)
+	} else if jobutil.Setting("DISCO_MASTER_HOST") == "" {
+		jobutil.SetKeyValue("DISCO_MASTER_HOST", defaultMaster)
+	}
+
+	options := jobpack.Options{Worker: worker, Inputs: inputs, Type: jobtype, Job: make(map[string]interface{}),
+		Files: files}
+	if dataFile != "" {
+		var err error
+		options.Data, err = ioutil.ReadFile(dataFile)
+		jobutil.Check(err)
+	}
+	if params != "" {
+		options.Params = json.RawMessage(params)
+	}
+	if jobConf != "" {
+		var err error
+		options.Job, err = jobpack.ReadJobOptions(jobConf)
+		jobutil.Check(err)
+	}
+	// the flags override the job config
+	flag.Visit(func(f *flag.Flag) {
+		if key, ok := jobOptionFlags[f.Name]; ok {
+			jobpack.SetJobOption(options.Job, key, f.Value.(flag.Getter).Get())
+		}
+	})
+	if local {
+		jobutil.Check(jobpack.RunLocal(options, output))
+		return
+	}
+
+	jp, err := jobpack.CreateJobPack(options)
+	jobutil.Check(err)
+	if save != "" {
+		file, err := os.Create(save)
+		jobutil.Check(err)
+		jobutil.Check(jp.Encode(file))
+		jobutil.Check(file.Close())
+		return
+	}
+	jobname, err := jobpack.Post(options, jp)
+	jobutil.Check(err)
+	fmt.Println(jobname)
+	print_results(options, jobname)
+}
+
+// print_results waits for the end of the job and prints its results.
+func print_results(options jobpack.Options, jobname string) {
+	progress := func(status string, err error) {
+		if err != nil {
+			log.Print("retrying: ", err)
+		}
+	}
+	outputs, err := jobpack.Wait(context.Background(), options, jobname, progress)
+	jobutil.Check(err)
+	disco_root := jobutil.Setting("DISCO_ROOT")
+	readCloser, err := jobutil.AddressReader(outputs, disco_root+"/data")
+	jobutil.Check(err)
+	defer readCloser.Close()
+
+	reader := bufio.NewReader(readCloser)
+	line := []byte("")
+	for {
+		thisRead, isPrefix, err := reader.ReadLine()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		line = append(line, thisRead...)
+		if !isPrefix {
+			fmt.Println(string(line))
+			line = []byte("")
+		}
+	}
+}
+
+// inspect is the inspect command, which prints the content of jobpack
+// files.
+func inspect(files []string) {
+	if len(files) == 0 {
+		fmt.Println("Usage: jobpack inspect FILE...")
+		os.Exit(1)
+	}
+	for _, name := range files {
+		file, err := os.Open(name)
+		jobutil.Check(err)
+		jp, err := jobpack.Decode(file)
+		file.Close()
+		if err != nil {
+			log.Fatal(name, ": ", err)
+		}
+		if len(files) > 1 {
+			fmt.Printf("%s:\n", name)
+		}
+		jobutil.Check(jobpack.Inspect(os.Stdout, jp))
+	}
+}
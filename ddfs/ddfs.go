@@ -0,0 +1,312 @@
+// Package ddfs is a client of DDFS, the distributed file system of Disco.
+// It talks to the HTTP API of the master to manage the tags, their
+// attributes and the blobs they point to:
+//
+//	client := ddfs.NewClient("http://localhost:8989")
+//	urls, err := client.Push("data:logs", []string{"logs.txt"}, 3)
+//	...
+//	blobs, err := client.Blobs("data:logs")
+package ddfs
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// TAG_PREFIX is the scheme of the urls which reference a tag.
+const TAG_PREFIX = "tag://"
+
+// Tag is the information of a tag.
+type Tag struct {
+	Id           string `json:"id"`
+	Version      int    `json:"version"`
+	LastModified string `json:"last-modified"`
+	// Urls are the replica sets of the tag: the urls of the replicas of
+	// every blob, or a single tag:// url referencing another tag.
+	Urls [][]string `json:"urls"`
+	// UserData holds the attributes set by the users.
+	UserData map[string]interface{} `json:"user-data"`
+}
+
+// Client is a client of the DDFS API of a Disco master.
+type Client struct {
+	// Master is the url of the master, like http://localhost:8989.
+	Master string
+	// Token is the authorization token of the tags, if any.
+	Token string
+	// HTTP is the client used for the requests.
+	HTTP *http.Client
+}
+
+// NewClient returns a client of the master at the given url.
+func NewClient(master string) *Client {
+	return &Client{Master: strings.TrimRight(master, "/"), HTTP: http.DefaultClient}
+}
+
+// Error is the error of a request which failed on the server.
+type Error struct {
+	URL        string
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %d %s", e.URL, e.StatusCode, e.Message)
+}
+
+// IsNotFound tells whether err is the error of a missing tag or attribute.
+func IsNotFound(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.StatusCode == http.StatusNotFound
+}
+
+// request sends a request and decodes the JSON reply into result, unless it
+// is nil.
+func (c *Client) request(method string, address string, body io.Reader, result interface{}) error {
+	req, err := http.NewRequest(method, address, body)
+	if err != nil {
+		return err
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("token:"+c.Token)))
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &Error{address, resp.StatusCode, strings.TrimSpace(string(data))}
+	}
+	if result == nil {
+		return nil
+	}
+	if err = json.Unmarshal(data, result); err != nil {
+		return fmt.Errorf("bad reply from %s: %s", address, err)
+	}
+	return nil
+}
+
+// send sends the JSON encoding of value.
+func (c *Client) send(method string, address string, value interface{}, result interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return c.request(method, address, bytes.NewReader(data), result)
+}
+
+func (c *Client) tagURL(tag string, attr string) string {
+	address := c.Master + "/ddfs/tag/" + url.PathEscape(strings.TrimPrefix(tag, TAG_PREFIX))
+	if attr != "" {
+		address += "/" + url.PathEscape(attr)
+	}
+	return address
+}
+
+// List returns the names of the tags which start with prefix.
+func (c *Client) List(prefix string) ([]string, error) {
+	var tags []string
+	err := c.request("GET", c.Master+"/ddfs/tags/"+url.PathEscape(prefix), nil, &tags)
+	return tags, err
+}
+
+// Get returns the information of a tag.
+func (c *Client) Get(tag string) (*Tag, error) {
+	info := new(Tag)
+	if err := c.request("GET", c.tagURL(tag, ""), nil, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Exists tells whether a tag exists.
+func (c *Client) Exists(tag string) (bool, error) {
+	_, err := c.Get(tag)
+	if IsNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Urls returns the replica sets of a tag, without resolving the tags it
+// references.
+func (c *Client) Urls(tag string) ([][]string, error) {
+	info, err := c.Get(tag)
+	if err != nil {
+		return nil, err
+	}
+	return info.Urls, nil
+}
+
+// GetAttr decodes the value of an attribute of a tag into value.
+func (c *Client) GetAttr(tag string, attr string, value interface{}) error {
+	return c.request("GET", c.tagURL(tag, attr), nil, value)
+}
+
+// SetAttr sets an attribute of a tag to the JSON encoding of value.  The
+// tag is created if it does not exist.
+func (c *Client) SetAttr(tag string, attr string, value interface{}) error {
+	return c.send("PUT", c.tagURL(tag, attr), value, nil)
+}
+
+// DelAttr deletes an attribute of a tag.
+func (c *Client) DelAttr(tag string, attr string) error {
+	return c.request("DELETE", c.tagURL(tag, attr), nil, nil)
+}
+
+// Tag adds replica sets to a tag, which is created if it does not exist.
+func (c *Client) Tag(tag string, urls [][]string) error {
+	return c.send("POST", c.tagURL(tag, ""), urls, nil)
+}
+
+// Put replaces the replica sets of a tag.
+func (c *Client) Put(tag string, urls [][]string) error {
+	return c.SetAttr(tag, "urls", urls)
+}
+
+// Delete deletes a tag.  The blobs it points to are garbage collected by
+// DDFS.
+func (c *Client) Delete(tag string) error {
+	return c.request("DELETE", c.tagURL(tag, ""), nil, nil)
+}
+
+var badBlobChars = regexp.MustCompile("[^A-Za-z0-9_\\-@:]")
+
+// blobName returns a valid blob name for a file.
+func blobName(path string) string {
+	return badBlobChars.ReplaceAllString(filepath.Base(path), "_")
+}
+
+// PushBlob stores the data of a local file in DDFS with the given number of
+// replicas, 0 for the default of the master, and returns the urls of the
+// replicas.
+func (c *Client) PushBlob(path string, replicas int) ([]string, error) {
+	address := c.Master + "/ddfs/new_blob/" + blobName(path)
+	if replicas > 0 {
+		address += "?replicas=" + strconv.Itoa(replicas)
+	}
+	var targets []string
+	if err := c.request("GET", address, nil, &targets); err != nil {
+		return nil, err
+	}
+	urls := make([]string, len(targets))
+	for i, target := range targets {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		err = c.request("PUT", target, file, &urls[i])
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return urls, nil
+}
+
+// Push stores local files in DDFS with the given number of replicas and adds
+// them to a tag.  It returns the new replica sets.
+func (c *Client) Push(tag string, paths []string, replicas int) ([][]string, error) {
+	urls := make([][]string, len(paths))
+	for i, path := range paths {
+		var err error
+		if urls[i], err = c.PushBlob(path, replicas); err != nil {
+			return nil, fmt.Errorf("could not push %s: %s", path, err)
+		}
+	}
+	if err := c.Tag(tag, urls); err != nil {
+		return nil, err
+	}
+	return urls, nil
+}
+
+// Blobs returns the replica sets of the blobs of the tags, replacing the
+// tag:// urls by the blobs of the tags they reference, recursively.  A tag
+// referenced more than once is only resolved once, which also stops the
+// cycles.  The referenced tags which do not exist are skipped, like Disco
+// does, but the tags given to Blobs have to exist.
+func (c *Client) Blobs(tags ...string) ([][]string, error) {
+	seen := make(map[string]bool)
+	result := make([][]string, 0)
+	for _, tag := range tags {
+		blobs, err := c.blobs(tag, seen, true)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, blobs...)
+	}
+	return result, nil
+}
+
+// Glob returns the names of the tags which match pattern, with the syntax of
+// path.Match.  A pattern without any special character is returned as it
+// is, whether the tag exists or not.
+func (c *Client) Glob(pattern string) ([]string, error) {
+	pattern = strings.TrimPrefix(pattern, TAG_PREFIX)
+	index := strings.IndexAny(pattern, "*?[\\")
+	if index == -1 {
+		return []string{pattern}, nil
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("bad tag pattern %s: %s", pattern, err)
+	}
+	tags, err := c.List(pattern[:index])
+	if err != nil {
+		return nil, err
+	}
+	result := make([]string, 0)
+	for _, tag := range tags {
+		if matched, _ := path.Match(pattern, tag); matched {
+			result = append(result, tag)
+		}
+	}
+	return result, nil
+}
+
+func (c *Client) blobs(tag string, seen map[string]bool, top bool) ([][]string, error) {
+	tag = strings.TrimPrefix(tag, TAG_PREFIX)
+	if seen[tag] {
+		return nil, nil
+	}
+	seen[tag] = true
+	urls, err := c.Urls(tag)
+	if err != nil {
+		if !top && IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	result := make([][]string, 0, len(urls))
+	for _, replicas := range urls {
+		if len(replicas) == 0 {
+			continue
+		}
+		if !strings.HasPrefix(replicas[0], TAG_PREFIX) {
+			result = append(result, replicas)
+			continue
+		}
+		nested, err := c.blobs(replicas[0], seen, false)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, nested...)
+	}
+	return result, nil
+}
@@ -0,0 +1,251 @@
+package ddfs
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeMaster serves the DDFS API from memory.
+type fakeMaster struct {
+	sync.Mutex
+	server *httptest.Server
+	tags   map[string]*Tag
+	blobs  map[string]string
+	auth   []string
+}
+
+func newFakeMaster() *fakeMaster {
+	m := &fakeMaster{tags: make(map[string]*Tag), blobs: make(map[string]string)}
+	m.server = httptest.NewServer(m)
+	return m
+}
+
+func (m *fakeMaster) tag(name string) *Tag {
+	tag, ok := m.tags[name]
+	if !ok {
+		tag = &Tag{Id: name, UserData: make(map[string]interface{})}
+		m.tags[name] = tag
+	}
+	return tag
+}
+
+func (m *fakeMaster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.Lock()
+	defer m.Unlock()
+	m.auth = append(m.auth, r.Header.Get("Authorization"))
+	path := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	body, _ := ioutil.ReadAll(r.Body)
+	reply := func(v interface{}) {
+		data, _ := json.Marshal(v)
+		w.Write(data)
+	}
+	switch {
+	case path[0] == "ddfs" && path[1] == "tags":
+		names := make([]string, 0)
+		for name := range m.tags {
+			if strings.HasPrefix(name, path[2]) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		reply(names)
+	case path[0] == "ddfs" && path[1] == "new_blob":
+		replicas := r.URL.Query().Get("replicas")
+		if replicas == "" {
+			replicas = "1"
+		}
+		targets := []string{}
+		for i := 0; i < int(replicas[0]-'0'); i++ {
+			targets = append(targets, m.server.URL+"/put/"+string('a'+byte(i))+"/"+path[2])
+		}
+		reply(targets)
+	case path[0] == "put" && r.Method == "PUT":
+		m.blobs[path[1]+"/"+path[2]] = string(body)
+		reply("disco://" + path[1] + "/ddfs/" + path[2])
+	case path[0] == "ddfs" && path[1] == "tag" && len(path) == 3:
+		tag, ok := m.tags[path[2]]
+		switch r.Method {
+		case "GET":
+			if !ok {
+				http.Error(w, "unknown tag", http.StatusNotFound)
+				return
+			}
+			reply(tag)
+		case "POST":
+			var urls [][]string
+			json.Unmarshal(body, &urls)
+			tag = m.tag(path[2])
+			tag.Urls = append(tag.Urls, urls...)
+			tag.Version++
+			reply(tag)
+		case "DELETE":
+			delete(m.tags, path[2])
+			reply("")
+		}
+	case path[0] == "ddfs" && path[1] == "tag" && len(path) == 4:
+		tag, ok := m.tags[path[2]]
+		switch r.Method {
+		case "GET":
+			value, found := tag.UserData[path[3]]
+			if !ok || !found {
+				http.Error(w, "unknown attribute", http.StatusNotFound)
+				return
+			}
+			reply(value)
+		case "PUT":
+			tag = m.tag(path[2])
+			if path[3] == "urls" {
+				json.Unmarshal(body, &tag.Urls)
+			} else {
+				var value interface{}
+				json.Unmarshal(body, &value)
+				tag.UserData[path[3]] = value
+			}
+			reply("")
+		case "DELETE":
+			if ok {
+				delete(tag.UserData, path[3])
+			}
+			reply("")
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestPush(t *testing.T) {
+	m := newFakeMaster()
+	defer m.server.Close()
+	dir, _ := ioutil.TempDir("", "ddfs")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "my file.txt")
+	ioutil.WriteFile(path, []byte("data"), 0644)
+
+	c := NewClient(m.server.URL)
+	urls, err := c.Push("data:test", []string{path}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]string{{"disco://a/ddfs/my_file_txt", "disco://b/ddfs/my_file_txt"}}
+	if !reflect.DeepEqual(urls, expected) {
+		t.Error("wrong urls", urls)
+	}
+	if m.blobs["b/my_file_txt"] != "data" {
+		t.Error("blob not stored", m.blobs)
+	}
+	if tagged, _ := c.Urls("data:test"); !reflect.DeepEqual(tagged, expected) {
+		t.Error("blob not tagged", tagged)
+	}
+	if _, err = c.Push("data:test", []string{filepath.Join(dir, "missing")}, 1); err == nil {
+		t.Error("no error for a missing file")
+	}
+}
+
+func TestTags(t *testing.T) {
+	m := newFakeMaster()
+	defer m.server.Close()
+	c := NewClient(m.server.URL + "/")
+	c.Token = "secret"
+	if err := c.Tag("data:a", [][]string{{"disco://h/ddfs/1"}}); err != nil {
+		t.Fatal(err)
+	}
+	c.Tag("data:b", [][]string{{"disco://h/ddfs/2"}})
+	c.Tag("other", [][]string{{"disco://h/ddfs/3"}})
+	if tags, err := c.List("data:"); err != nil || !reflect.DeepEqual(tags, []string{"data:a", "data:b"}) {
+		t.Error("wrong tags", tags, err)
+	}
+	if err := c.Put("data:a", [][]string{{"disco://h/ddfs/4"}}); err != nil {
+		t.Fatal(err)
+	}
+	if urls, _ := c.Urls("tag://data:a"); !reflect.DeepEqual(urls, [][]string{{"disco://h/ddfs/4"}}) {
+		t.Error("urls not replaced", urls)
+	}
+	if err := c.Delete("data:a"); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := c.Exists("data:a"); exists || err != nil {
+		t.Error("tag not deleted", err)
+	}
+	if _, err := c.Get("data:a"); !IsNotFound(err) {
+		t.Error("wrong error for a missing tag", err)
+	}
+	if m.auth[0] != "Basic dG9rZW46c2VjcmV0" {
+		t.Error("wrong authorization", m.auth[0])
+	}
+}
+
+func TestAttributes(t *testing.T) {
+	m := newFakeMaster()
+	defer m.server.Close()
+	c := NewClient(m.server.URL)
+	if err := c.SetAttr("data:a", "owner", "me"); err != nil {
+		t.Fatal(err)
+	}
+	var owner string
+	if err := c.GetAttr("data:a", "owner", &owner); err != nil || owner != "me" {
+		t.Error("wrong attribute", owner, err)
+	}
+	if info, _ := c.Get("data:a"); info.UserData["owner"] != "me" {
+		t.Error("attribute not in the user data", info.UserData)
+	}
+	if err := c.DelAttr("data:a", "owner"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.GetAttr("data:a", "owner", &owner); !IsNotFound(err) {
+		t.Error("attribute not deleted", err)
+	}
+}
+
+func TestBlobs(t *testing.T) {
+	m := newFakeMaster()
+	defer m.server.Close()
+	c := NewClient(m.server.URL)
+	c.Tag("top", [][]string{{"disco://h/ddfs/1"}, {"tag://nested"}, {"tag://missing"}})
+	c.Tag("nested", [][]string{{"disco://h/ddfs/2", "disco://g/ddfs/2"}, {"tag://top"}, {"tag://leaf"}})
+	c.Tag("leaf", [][]string{{"disco://h/ddfs/3"}})
+	blobs, err := c.Blobs("top")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]string{{"disco://h/ddfs/1"}, {"disco://h/ddfs/2", "disco://g/ddfs/2"}, {"disco://h/ddfs/3"}}
+	if !reflect.DeepEqual(blobs, expected) {
+		t.Error("wrong blobs", blobs)
+	}
+	if _, err = c.Blobs("missing"); !IsNotFound(err) {
+		t.Error("wrong error for a missing tag", err)
+	}
+}
+
+func TestGlob(t *testing.T) {
+	m := newFakeMaster()
+	defer m.server.Close()
+	c := NewClient(m.server.URL)
+	for _, tag := range []string{"logs:2020:01", "logs:2020:02", "logs:2021:01", "other"} {
+		c.Tag(tag, [][]string{{"disco://h/ddfs/" + tag}})
+	}
+	if tags, err := c.Glob("tag://logs:*:01"); err != nil || !reflect.DeepEqual(tags, []string{"logs:2020:01", "logs:2021:01"}) {
+		t.Error("wrong tags", tags, err)
+	}
+	if tags, err := c.Glob("logs:2020:0[2-9]"); err != nil || !reflect.DeepEqual(tags, []string{"logs:2020:02"}) {
+		t.Error("wrong tags", tags, err)
+	}
+	if tags, _ := c.Glob("missing"); !reflect.DeepEqual(tags, []string{"missing"}) {
+		t.Error("plain tag name not kept", tags)
+	}
+	if _, err := c.Glob("logs:[2020"); err == nil {
+		t.Error("no error for a bad pattern")
+	}
+	blobs, err := c.Blobs("logs:2020:01", "logs:2021:01", "logs:2020:01")
+	if err != nil || len(blobs) != 2 {
+		t.Error("wrong blobs of several tags", blobs, err)
+	}
+}
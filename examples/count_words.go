@@ -6,7 +6,6 @@ import (
 	"github.com/discoproject/goworker/jobutil"
 	"github.com/discoproject/goworker/worker"
 	"io"
-	"log"
 	"strings"
 )
 
@@ -17,26 +16,23 @@ func Map(reader io.Reader, writer io.Writer) {
 		words := strings.Fields(text)
 		for _, word := range words {
 			_, err := writer.Write([]byte(word + "\n"))
-			jobutil.Check(err)
+			worker.Check(err)
 		}
 	}
-	if err := scanner.Err(); err != nil {
-		log.Fatal("reading standard input:", err)
-	}
+	worker.Check(scanner.Err())
 }
 
 func Reduce(reader io.Reader, writer io.Writer) {
-	sreader := jobutil.Sorted(reader)
+	sreader, err := jobutil.Sorted(reader)
+	worker.Check(err)
 	grouper := jobutil.Grouper(sreader)
 
 	for grouper.Scan() {
 		word, count := grouper.Text()
 		_, err := writer.Write([]byte(fmt.Sprintf("%d %s\n", count, word)))
-		jobutil.Check(err)
-	}
-	if err := grouper.Err(); err != nil {
-		jobutil.Check(err)
+		worker.Check(err)
 	}
+	worker.Check(grouper.Err())
 	sreader.Close()
 }
 
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/discoproject/goworker/jobutil"
+	"github.com/discoproject/goworker/worker"
+	"io"
+	"strings"
+)
+
+const NR_PARTITIONS = 4
+
+// Map sends every word to one of the NR_PARTITIONS labels.
+func Map(reader io.Reader, writer io.Writer) {
+	out := writer.(*worker.Writer)
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		for _, word := range strings.Fields(scanner.Text()) {
+			label := worker.HashPartitioner([]byte(word), NR_PARTITIONS)
+			_, err := out.Label(label).Write([]byte(word + "\n"))
+			worker.Check(err)
+		}
+	}
+	worker.Check(scanner.Err())
+}
+
+// Count receives all the words of one label.
+func Count(reader io.Reader, writer io.Writer) {
+	sreader, err := jobutil.Sorted(reader)
+	worker.Check(err)
+	grouper := jobutil.Grouper(sreader)
+
+	for grouper.Scan() {
+		word, count := grouper.Text()
+		_, err := writer.Write([]byte(fmt.Sprintf("%d %s\n", count, word)))
+		worker.Check(err)
+	}
+	worker.Check(grouper.Err())
+	sreader.Close()
+}
+
+func main() {
+	worker.RunPipeline([]worker.Stage{
+		{Name: "map", Grouping: worker.Split, Process: Map},
+		{Name: "count", Grouping: worker.GroupLabel, Process: Count},
+	})
+}
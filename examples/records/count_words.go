@@ -0,0 +1,32 @@
+package main
+
+import (
+	"bytes"
+
+	"github.com/discoproject/goworker/worker"
+)
+
+func Map(record []byte, out *worker.Emitter) error {
+	for _, word := range bytes.Fields(record) {
+		if err := out.Emit(word, 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func Reduce(key worker.Key, values *worker.Values, out *worker.Emitter) error {
+	total, count := 0, 0
+	for values.Next(&count) {
+		total += count
+	}
+	return out.Emit(key.String(), total)
+}
+
+func main() {
+	// the options of the job, which can be overridden with jobpack
+	worker.SetJobOptions(worker.JobOptions{Prefix: "count_words", Partitions: 2})
+	reduce := worker.ReduceRecords(Reduce, worker.TextCodec)
+	// the counts of every map are added up before they are sent to the reduce
+	worker.Run(worker.Combine(worker.MapRecords(Map, worker.TextCodec), reduce), reduce)
+}
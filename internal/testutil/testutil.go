@@ -0,0 +1,106 @@
+// Package testutil writes the input files and the jobpacks used by the tests
+// of the other packages.
+package testutil
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// TempFiles writes the files, by slash separated name, in a new temporary
+// directory and returns the directory.
+func TempFiles(t testing.TB, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "goworker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// TempInputs writes an input file for every content in a new temporary
+// directory and returns the directory and the names of the files.
+func TempInputs(t testing.TB, contents ...string) (string, []string) {
+	files := make(map[string]string, len(contents))
+	for i, content := range contents {
+		files[fmt.Sprintf("input%d", i)] = content
+	}
+	dir := TempFiles(t, files)
+	names := make([]string, len(contents))
+	for i := range contents {
+		names[i] = filepath.Join(dir, fmt.Sprintf("input%d", i))
+	}
+	return dir, names
+}
+
+// JobPack encodes a jobpack with the magic and version of its header, the
+// jobdict and the jobenv, the files of the job home, by name, and the
+// jobdata.  The "job" file is executable.
+func JobPack(t testing.TB, magic uint32, jobdict string, jobenv string, files map[string]string,
+	data string) []byte {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var home bytes.Buffer
+	w := zip.NewWriter(&home)
+	for _, name := range names {
+		header := &zip.FileHeader{Name: name, Method: zip.Deflate}
+		header.SetMode(0644)
+		if name == "job" {
+			header.SetMode(0755)
+		}
+		f, err := w.CreateHeader(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(files[name]))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var jobpack bytes.Buffer
+	header := make([]uint32, 32)
+	header[0] = magic
+	header[1] = uint32(len(header) * 4)
+	header[2] = header[1] + uint32(len(jobdict))
+	header[3] = header[2] + uint32(len(jobenv))
+	header[4] = header[3] + uint32(home.Len())
+	binary.Write(&jobpack, binary.BigEndian, header)
+	jobpack.WriteString(jobdict)
+	jobpack.WriteString(jobenv)
+	jobpack.Write(home.Bytes())
+	jobpack.WriteString(data)
+	return jobpack.Bytes()
+}
+
+// TempJobPack writes the JobPack of the jobdict, the files and the jobdata,
+// with an empty jobenv, in a new temporary file and returns its name.
+func TempJobPack(t testing.TB, magic uint32, jobdict string, files map[string]string, data string) string {
+	file, err := ioutil.TempFile("", "jobpack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err = file.Write(JobPack(t, magic, jobdict, "{}", files, data)); err != nil {
+		t.Fatal(err)
+	}
+	return file.Name()
+}
@@ -0,0 +1,41 @@
+package jobpack
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Inspect prints the header, the jobdict, the jobenv and the files of the
+// job home of a jobpack, and its jobdata when it is JSON.
+func Inspect(w io.Writer, jp *JobPack) error {
+	h := jp.Header
+	fmt.Fprintf(w, "version: %d\n", jp.Version())
+	fmt.Fprintf(w, "offsets: jobdict %d, jobenv %d, jobhome %d, jobdata %d\n",
+		h.JobDictOffset, h.JobEnvOffset, h.JobHomeOffset, h.JobDataOffset)
+	for _, part := range []struct {
+		name  string
+		value map[string]interface{}
+	}{{"jobdict", jp.JobDict}, {"jobenv", jp.JobEnv}} {
+		data, err := json.MarshalIndent(part.value, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s:\n%s\n", part.name, data)
+	}
+	files, err := jp.Files()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "jobhome: %d bytes\n", len(jp.JobHome))
+	for _, file := range files {
+		fmt.Fprintf(w, "  %s %10d %s\n", file.Mode(), file.UncompressedSize64, file.Name)
+	}
+	_, err = fmt.Fprintf(w, "jobdata: %d bytes\n", len(jp.JobData))
+	var params bytes.Buffer
+	if err == nil && len(jp.JobData) > 0 && json.Indent(&params, jp.JobData, "", "  ") == nil {
+		_, err = fmt.Fprintf(w, "%s\n", params.Bytes())
+	}
+	return err
+}
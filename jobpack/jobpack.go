@@ -1,14 +1,31 @@
-package main
+// Package jobpack builds the jobpacks of the Go workers and submits them to
+// a Disco master:
+//
+//	options := jobpack.Options{Worker: "count_words.go", Inputs: inputs}
+//	jp, err := jobpack.CreateJobPack(options)
+//	if err != nil {
+//		...
+//	}
+//	jobname, err := jobpack.Post(options, jp)
+//
+// It also decodes the jobpacks, see Decode.  The jobpack command is a thin
+// wrapper of this package.
+package jobpack
 
 import (
 	"archive/zip"
+	"bytes"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"fmt"
 
+	"github.com/discoproject/goworker/ddfs"
 	"github.com/discoproject/goworker/jobutil"
+	"github.com/discoproject/goworker/worker"
 
 	"io"
-	"log"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"os/user"
@@ -17,37 +34,74 @@ import (
 )
 
 const (
-	MAGIC       = 0xd5c0 << 16
-	MAGIC_MASK  = 0xffff << 16
+	MAGIC       = worker.JOBPACK_MAGIC
+	MAGIC_MASK  = worker.JOBPACK_MAGIC_MASK
 	VERSION_1   = 0x0001
-	VERSION_2   = 0x0001
+	VERSION_2   = 0x0002
 	HEADER_SIZE = 128
 )
 
+// The types of jobs.
+const (
+	MAPREDUCE = "mapreduce"
+	PIPELINE  = "pipeline"
+)
+
+// Options are the options of a job.
+type Options struct {
+	// Worker is the directory or the .go file of the worker, which is
+	// compiled, or its executable.
+	Worker string
+	// Inputs are the urls of the inputs of the job, see getEffectiveInputs
+	// for the tag:// urls.
+	Inputs []string
+	// Type is MAPREDUCE, the default, or PIPELINE.
+	Type string
+	// Master is the url of the master, like http://localhost:8989.  It
+	// defaults to the DISCO_MASTER_HOST and DISCO_PORT settings.
+	Master string
+	// Job are the options of the job, with the keys of worker.JobOptions,
+	// which override those declared by the worker.  See ReadJobOptions
+	// and SetJobOption.
+	Job map[string]interface{}
+	// Files are files and directories added to the job home with the
+	// worker, see worker.JobFile.
+	Files []string
+	// Data is the jobdata of the job, or Params, which is encoded in JSON
+	// as the jobdata, see worker.JobData and worker.Params.
+	Data   []byte
+	Params interface{}
+}
+
+func (o *Options) master() string {
+	if o.Master != "" {
+		return strings.TrimRight(o.Master, "/")
+	}
+	return "http://" + jobutil.Setting("DISCO_MASTER_HOST") + ":" + jobutil.Setting("DISCO_PORT")
+}
+
+// JobPack is the content of a jobpack.  Only the version of the Header is
+// used by Encode, which computes the offsets.
 type JobPack struct {
-	jobdict map[string]interface{}
-	jobenv  map[string]interface{}
-	jobhome string
-	jobdata string
+	Header  Header
+	JobDict map[string]interface{}
+	JobEnv  map[string]interface{}
+	// JobHome is the zip file of the job home, with the worker.
+	JobHome []byte
+	JobData []byte
 }
 
 func (jp *JobPack) Init() {
-	jp.jobdict = make(map[string]interface{})
-	jp.jobenv = make(map[string]interface{})
+	jp.JobDict = make(map[string]interface{})
+	jp.JobEnv = make(map[string]interface{})
 }
 
 func (jp *JobPack) AddToJobDict(key string, value interface{}) {
-	jp.jobdict[key] = value
+	jp.JobDict[key] = value
 }
 
 func (jp *JobPack) AddToJobEnv(key string, value interface{}) {
-	jp.jobenv[key] = value
-}
-
-func Check(err error) {
-	if err != nil {
-		log.Fatal(err)
-	}
+	jp.JobEnv[key] = value
 }
 
 type Header struct {
@@ -59,208 +113,401 @@ type Header struct {
 	_             [27]uint32
 }
 
-func compile(worker string) string {
-	pwd, err := os.Getwd()
-	Check(err)
-	var workerDir string
-
-	exeFile := "worker"
-
+// compile builds the worker in dir, unless it is an executable, and returns
+// the path of its executable.
+func compile(worker string, dir string) (string, error) {
 	// Check if we have access to file or path, and it exists
-	var fileStat os.FileInfo
-	fileStat, err = os.Stat(worker)
-	Check(err)
+	fileStat, err := os.Stat(worker)
+	if err != nil {
+		return "", err
+	}
 
+	exeFile := filepath.Join(dir, "worker")
+	var cmd *exec.Cmd
 	if fileStat.IsDir() {
-		workerDir = worker
-		err = os.Chdir(workerDir)
-		Check(err)
-		buildMessages, err := exec.Command("go", "build", "-o", exeFile).CombinedOutput()
-		if err != nil {
-			log.Fatal(string(buildMessages))
-		}
+		cmd = exec.Command("go", "build", "-o", exeFile)
+		cmd.Dir = worker
 	} else if strings.HasSuffix(worker, ".go") {
-		var file string
-		workerDir, file = filepath.Split(worker)
-		if workerDir != "" {
-			err = os.Chdir(workerDir)
-			Check(err)
-		}
-		buildMessages, err := exec.Command("go", "build", "-o", exeFile, file).CombinedOutput()
-		if err != nil {
-			log.Fatal(string(buildMessages))
-		}
+		workerDir, file := filepath.Split(worker)
+		cmd = exec.Command("go", "build", "-o", exeFile, file)
+		cmd.Dir = workerDir
 	} else {
 		// Is a file, is not a directory, fall back to executable
-		exeFile = worker
+		return worker, nil
+	}
+	if buildMessages, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("could not compile the worker: %s\n%s", err, buildMessages)
 	}
-	err = os.Chdir(pwd)
-	Check(err)
-	return filepath.Join(workerDir, exeFile)
+	return exeFile, nil
 }
 
-func zipit(workerExe string) string {
-	//Open this executable for reading
-	exeFile, err := os.Open(workerExe)
-	Check(err)
-	defer exeFile.Close()
-
-	// create the zipfile
-	zipfile, err := os.Create(workerExe + ".zip")
-	Check(err)
-	defer zipfile.Close()
-
-	// set w to write to zipfile
-	w := zip.NewWriter(zipfile)
+// zipit returns the zip file of the job home, with the executable of the
+// worker as job and the files, by base name.  The directories are added
+// with all their files.
+func zipit(workerExe string, files []string) ([]byte, error) {
+	var zipfile bytes.Buffer
+	w := zip.NewWriter(&zipfile)
+	names := map[string]bool{"job": true}
+
+	header := &zip.FileHeader{Name: "job", Method: zip.Deflate}
+	header.SetMode(0755)
+	if err := zipFile(w, header, workerExe); err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		root := filepath.Dir(filepath.Clean(file))
+		err := filepath.Walk(file, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			name, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			name = filepath.ToSlash(name)
+			if names[name] {
+				return errors.New("duplicate file in the job home: " + name)
+			}
+			names[name] = true
+			header, err := zip.FileInfoHeader(info)
+			if err != nil {
+				return err
+			}
+			header.Name = name
+			header.Method = zip.Deflate
+			return zipFile(w, header, path)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return zipfile.Bytes(), nil
+}
 
-	f, err := w.Create("job")
-	Check(err)
+// zipFile adds a file to a zip file.
+func zipFile(w *zip.Writer, header *zip.FileHeader, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	f, err := w.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, file)
+	return err
+}
 
-	_, err = io.Copy(f, exeFile)
-	Check(err)
+// jobData returns the jobdata of the job, its Data or the JSON encoding of
+// its Params.
+func jobData(options *Options) ([]byte, error) {
+	if options.Params == nil {
+		return options.Data, nil
+	}
+	if options.Data != nil {
+		return nil, errors.New("both jobdata and params are set")
+	}
+	data, err := json.Marshal(options.Params)
+	if err != nil {
+		return nil, fmt.Errorf("bad job params: %s", err)
+	}
+	return data, nil
+}
 
-	err = w.Close()
-	Check(err)
+// encodeJSON returns the JSON encodings of the jobdict and of the jobenv.
+func (jp *JobPack) encodeJSON() ([]byte, []byte, error) {
+	jobdict, err := json.Marshal(jp.JobDict)
+	if err != nil {
+		return nil, nil, err
+	}
+	jobenv, err := json.Marshal(jp.JobEnv)
+	if jp.JobEnv == nil {
+		jobenv = []byte("{}")
+	}
+	return jobdict, jobenv, err
+}
 
-	return workerExe + ".zip"
+// Size returns the size of the encoding of the jobpack.
+func (jp *JobPack) Size() (int64, error) {
+	jobdict, jobenv, err := jp.encodeJSON()
+	size := HEADER_SIZE + len(jobdict) + len(jobenv) + len(jp.JobHome) + len(jp.JobData)
+	return int64(size), err
 }
 
-func Encode(jobdict map[string]interface{}, jobenv map[string]interface{},
-	zipFileName string, version uint32) {
-	job_dict, err := json.Marshal(jobdict)
-	Check(err)
+// Encode writes the header, the jobdict, the jobenv, the job home and the
+// jobdata of the jobpack to w.  A jobpack without a version is encoded with
+// VERSION_1.
+func (jp *JobPack) Encode(w io.Writer) error {
+	job_dict, job_env, err := jp.encodeJSON()
+	if err != nil {
+		return err
+	}
 	job_dict_len := len(job_dict)
-
-	job_env, err := json.Marshal(jobenv)
-	Check(err)
 	job_env_len := len(job_env)
-
-	//TODO there is no need to create the zipfile, we can actually pass the file to
-	//zipit and it will zip into jp.
-	zipfile, err := os.Open(zipFileName)
-	Check(err)
-	defer zipfile.Close()
-
-	fileinfo, err := zipfile.Stat()
-	Check(err)
-	jobHomeSize := int(fileinfo.Size())
+	jobHomeSize := len(jp.JobHome)
 
 	var header Header
-	header.MV = uint32(MAGIC + version)
+	header.MV = MAGIC + jp.Version()
+	if jp.Version() == 0 {
+		header.MV = MAGIC + VERSION_1
+	}
 	header.JobDictOffset = uint32(HEADER_SIZE)
 	header.JobEnvOffset = uint32(HEADER_SIZE + job_dict_len)
 	header.JobHomeOffset = uint32(HEADER_SIZE + job_dict_len + job_env_len)
 	header.JobDataOffset = uint32(HEADER_SIZE + job_dict_len + job_env_len + jobHomeSize)
 
-	file, err := os.Create("jp")
-	Check(err)
-	err = binary.Write(file, binary.BigEndian, header)
-	Check(err)
-	binary.Write(file, binary.BigEndian, job_dict)
-	binary.Write(file, binary.BigEndian, job_env)
+	if err = binary.Write(w, binary.BigEndian, header); err != nil {
+		return err
+	}
+	for _, part := range [][]byte{job_dict, job_env, jp.JobHome, jp.JobData} {
+		if _, err = w.Write(part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	io.Copy(file, zipfile)
-	file.Close()
+// Version returns the version of the format of a decoded jobpack.
+func (jp *JobPack) Version() uint32 {
+	return jp.Header.MV &^ MAGIC_MASK
 }
 
-// Decoder, currently unused
-func Decode() {
-	file, err := os.Open("jp")
-	Check(err)
-	var header Header
-	err = binary.Read(file, binary.BigEndian, &header)
-	// magic := header.MV & MAGIC_MASK
-
-	job_dict_buf := make([]byte, header.JobEnvOffset-header.JobDictOffset)
-	err = binary.Read(file, binary.BigEndian, &job_dict_buf)
-	job_dict := make(map[string]interface{})
-	err = json.Unmarshal(job_dict_buf, &job_dict)
-	Check(err)
-
-	job_env_buf := make([]byte, header.JobHomeOffset-header.JobEnvOffset)
-	err = binary.Read(file, binary.BigEndian, &job_env_buf)
-	job_env := make(map[string]interface{})
-	err = json.Unmarshal(job_env_buf, &job_env)
-	Check(err)
+// Files returns the files of the job home of a decoded jobpack.
+func (jp *JobPack) Files() ([]*zip.File, error) {
+	r, err := zip.NewReader(bytes.NewReader(jp.JobHome), int64(len(jp.JobHome)))
+	if err != nil {
+		return nil, fmt.Errorf("bad jobpack job home: %s", err)
+	}
+	return r.File, nil
 }
 
-func getEffectiveInputs(inputs []string) []string {
-	effectiveInputs := make([]string, 0)
+// Decode reads a jobpack, checking its header and the encoding of its
+// parts.
+func Decode(r io.Reader) (*JobPack, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < HEADER_SIZE {
+		return nil, errors.New("jobpack too short")
+	}
+	jp := new(JobPack)
+	if err = binary.Read(bytes.NewReader(data), binary.BigEndian, &jp.Header); err != nil {
+		return nil, err
+	}
+	h := jp.Header
+	if h.MV&MAGIC_MASK != MAGIC {
+		return nil, fmt.Errorf("bad jobpack magic: %#x", h.MV)
+	}
+	if version := jp.Version(); version != VERSION_1 && version != VERSION_2 {
+		return nil, fmt.Errorf("unsupported jobpack version: %d", version)
+	}
+	if h.JobDictOffset < HEADER_SIZE || h.JobEnvOffset < h.JobDictOffset ||
+		h.JobHomeOffset < h.JobEnvOffset || h.JobDataOffset < h.JobHomeOffset ||
+		int(h.JobDataOffset) > len(data) {
+		return nil, fmt.Errorf("bad jobpack offsets: %d %d %d %d",
+			h.JobDictOffset, h.JobEnvOffset, h.JobHomeOffset, h.JobDataOffset)
+	}
 
-	for _, input := range inputs {
+	if err = json.Unmarshal(data[h.JobDictOffset:h.JobEnvOffset], &jp.JobDict); err != nil {
+		return nil, fmt.Errorf("bad jobpack jobdict: %s", err)
+	}
+	if h.JobHomeOffset > h.JobEnvOffset {
+		if err = json.Unmarshal(data[h.JobEnvOffset:h.JobHomeOffset], &jp.JobEnv); err != nil {
+			return nil, fmt.Errorf("bad jobpack jobenv: %s", err)
+		}
+	}
+	jp.JobHome = data[h.JobHomeOffset:h.JobDataOffset]
+	if _, err = jp.Files(); err != nil {
+		return nil, err
+	}
+	jp.JobData = data[h.JobDataOffset:]
+	return jp, nil
+}
+
+// ddfsClient returns a client of the DDFS of the master.
+func ddfsClient(options *Options) (*ddfs.Client, error) {
+	client := ddfs.NewClient(options.master())
+	client.Token = jobutil.Setting("DDFS_READ_TOKEN")
+	var err error
+	client.HTTP, err = jobutil.HTTPClient()
+	return client, err
+}
+
+// getEffectiveInputs returns the replica sets of the inputs of the job, in
+// the order of the inputs.  The tag:// inputs are replaced by the blobs of
+// the tags, resolving the tags they reference recursively, and their names
+// can be patterns like tag://logs:2020:*, see ddfs.Client.Glob.  The other
+// inputs are replica sets of a single url.
+func getEffectiveInputs(options *Options) ([][]string, error) {
+	effectiveInputs := make([][]string, 0)
+	client, err := ddfsClient(options)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, input := range options.Inputs {
 		if scheme, rest := jobutil.SchemeSplit(input); scheme == "tag" {
-			urls := jobutil.GetUrls(rest)
-			for _, url := range urls {
-				// TODO we are using only the first replica here
-				effectiveInputs = append(effectiveInputs, url[0])
+			matches, err := client.Glob(rest)
+			if err != nil {
+				return nil, err
+			}
+			if len(matches) == 0 {
+				return nil, errors.New("no tag matches " + input)
 			}
+			blobs, err := client.Blobs(matches...)
+			if err != nil {
+				return nil, err
+			}
+			effectiveInputs = append(effectiveInputs, blobs...)
 		} else {
-			effectiveInputs = append(effectiveInputs, input)
+			effectiveInputs = append(effectiveInputs, []string{input})
 		}
 	}
-	return effectiveInputs
+	return effectiveInputs, nil
 }
 
-func CreateJobPack(inputs []string, worker string, jobtype string) {
-	if jobtype == "mapreduce" {
-		createMapReduceJobPack(inputs, worker)
-	} else {
-		createPipelineJobPack(inputs, worker)
+// compileWorker compiles the worker in dir and returns the path of its
+// executable, its description and the options of the job.
+func compileWorker(options *Options, dir string) (string, *description, *worker.JobOptions, error) {
+	workerExe, err := compile(options.Worker, dir)
+	if err != nil {
+		return "", nil, nil, err
 	}
+	d, err := describeWorker(workerExe)
+	if err != nil {
+		// the map/reduce executables built with older versions of the
+		// worker package run with the default options
+		if err != errNoDescribe || workerExe != options.Worker || options.Type == PIPELINE {
+			return "", nil, nil, err
+		}
+		d = new(description)
+	}
+	job, err := jobOptions(d.Options, options)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	return workerExe, d, job, nil
 }
 
-func createPipelineJobPack(inputs []string, worker string) {
-	jp := createCommonJobPack(inputs)
-	// TODO
-	// pipeline is a list like [("map", split, false)]
-	zipAndEncodeJobPack(jp, worker, VERSION_2)
+// CreateJobPack compiles the worker and returns the jobpack of the job.
+func CreateJobPack(options Options) (*JobPack, error) {
+	dir, err := ioutil.TempDir("", "jobpack")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	jp, _, _, err := createJobPack(&options, dir)
+	return jp, err
 }
 
-func createMapReduceJobPack(inputs []string, worker string) {
-	jp := createCommonJobPack(inputs)
+// createJobPack compiles the worker in dir and returns the jobpack of the
+// job, the executable of the worker and the options of the job.
+func createJobPack(options *Options, dir string) (*JobPack, string, *worker.JobOptions, error) {
+	var version uint32
+	switch options.Type {
+	case MAPREDUCE, "":
+		version = VERSION_1
+	case PIPELINE:
+		version = VERSION_2
+	default:
+		return nil, "", nil, errors.New("unknown job type: " + options.Type)
+	}
+	data, err := jobData(options)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	workerExe, description, job, err := compileWorker(options, dir)
+	if err != nil {
+		return nil, "", nil, err
+	}
 
-	jp.AddToJobDict("reduce?", true)
-	jp.AddToJobDict("map?", true)
+	jp, err := createCommonJobPack(options, job)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	jp.Header.MV = MAGIC + version
+	jp.JobData = data
+
+	if version == VERSION_2 {
+		if len(description.Pipeline) == 0 {
+			return nil, "", nil, errors.New("the worker does not define a pipeline, did it call worker.RunPipeline?")
+		}
+		jp.AddToJobDict("pipeline", description.Pipeline)
+		jp.AddToJobDict("input", pipelineInputs(jp.JobDict["input"].([][]string)))
+	} else {
+		jp.AddToJobDict("reduce?", true)
+		jp.AddToJobDict("map?", true)
+	}
 
-	zipAndEncodeJobPack(jp, worker, VERSION_1)
+	jp.JobHome, err = zipit(workerExe, options.Files)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	return jp, workerExe, job, nil
 }
 
-func zipAndEncodeJobPack(jp JobPack, worker string, version uint32) {
-	workerExe := compile(worker)
-	zipFileName := zipit(workerExe)
-	Encode(jp.jobdict, jp.jobenv, zipFileName, version)
+// pipelineInputs converts the replica sets of the inputs to the
+// [label, size_hint, [url, ...]] format of the pipeline jobs.
+func pipelineInputs(inputs [][]string) [][]interface{} {
+	result := make([][]interface{}, len(inputs))
+	for i, replicas := range inputs {
+		result[i] = []interface{}{0, 0, replicas}
+	}
+	return result
 }
 
 /*
-    TODO: read the options from a file or get the from the argument list.
     TODO: use env
 	jp.AddToJobEnv("en", "v")
 */
-func createCommonJobPack(inputs []string) JobPack {
-	var jp JobPack
+func createCommonJobPack(options *Options, job *worker.JobOptions) (*JobPack, error) {
+	jp := new(JobPack)
 
 	jp.Init()
 	host, err := os.Hostname()
-	Check(err)
+	if err != nil {
+		return nil, err
+	}
 
 	user, err := user.Current()
-	Check(err)
+	if err != nil {
+		return nil, err
+	}
 
-	jp.AddToJobDict("prefix", "gojob")
+	jp.AddToJobDict("prefix", job.Prefix)
 	jp.AddToJobDict("owner", user.Username+"@"+host)
-	// Send an empty scheduler
-	jp.AddToJobDict("scheduler", make(map[string]string))
-	jp.AddToJobDict("save_info", "ddfs")
+	jp.AddToJobDict("scheduler", schedulerOptions(job.Scheduler))
+	jp.AddToJobDict("save_info", job.SaveInfo)
 	jp.AddToJobDict("worker", "./job")
-	jp.AddToJobDict("nr_reduces", 1)
-	jp.AddToJobDict("save_results", false)
+	jp.AddToJobDict("nr_reduces", job.NrReduces)
+	jp.AddToJobDict("save_results", job.SaveResults)
 
-	jp.AddToJobDict("input", getEffectiveInputs(inputs))
-	return jp
+	inputs, err := getEffectiveInputs(options)
+	if err != nil {
+		return nil, err
+	}
+	jp.AddToJobDict("input", inputs)
+	return jp, nil
 }
 
-func Cleanup() {
-	os.Remove("jp")                // ignore error
-	os.Remove("worker/worker.zip") // ignore error
-
+// schedulerOptions returns the scheduler of the jobdict, with only the
+// options which are set.
+func schedulerOptions(scheduler worker.Scheduler) map[string]interface{} {
+	result := make(map[string]interface{})
+	if scheduler.MaxCores > 0 {
+		result["max_cores"] = scheduler.MaxCores
+	}
+	if scheduler.ForceLocal {
+		result["force_local"] = true
+	}
+	if scheduler.ForceRemote {
+		result["force_remote"] = true
+	}
+	return result
 }
@@ -0,0 +1,262 @@
+package jobpack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/discoproject/goworker/internal/testutil"
+)
+
+// testJobPack returns a jobpack with a fake worker.
+func testJobPack(t *testing.T) *JobPack {
+	dir := testutil.TempFiles(t, map[string]string{"worker": "binary"})
+	defer os.RemoveAll(dir)
+
+	jp := new(JobPack)
+	jp.Init()
+	jp.Header.MV = MAGIC + VERSION_2
+	jp.AddToJobDict("prefix", "gojob")
+	jp.AddToJobDict("input", [][]string{{"raw://a"}})
+	jp.AddToJobEnv("LANG", "C")
+	var err error
+	if jp.JobHome, err = zipit(filepath.Join(dir, "worker"), nil); err != nil {
+		t.Fatal(err)
+	}
+	return jp
+}
+
+// encoded returns an encoding of testJobPack.
+func encoded(t *testing.T) []byte {
+	return testutil.JobPack(t, MAGIC+VERSION_2, `{"prefix":"gojob","input":[["raw://a"]]}`, `{"LANG":"C"}`,
+		map[string]string{"job": "binary"}, "")
+}
+
+func TestDecode(t *testing.T) {
+	jp, err := Decode(bytes.NewReader(encoded(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if jp.Version() != VERSION_2 || jp.JobDict["prefix"] != "gojob" || jp.JobEnv["LANG"] != "C" {
+		t.Error("wrong jobpack", jp.Version(), jp.JobDict, jp.JobEnv)
+	}
+	files, err := jp.Files()
+	if err != nil || len(files) != 1 || files[0].Name != "job" || files[0].UncompressedSize64 != 6 {
+		t.Error("wrong job home", files, err)
+	}
+	if len(jp.JobData) != 0 {
+		t.Error("wrong jobdata", jp.JobData)
+	}
+
+	var out bytes.Buffer
+	if err = Inspect(&out, jp); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"version: 2\n", "\"prefix\": \"gojob\"", "\"LANG\": \"C\"", " 6 job\n", "jobdata: 0 bytes\n"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("%q not in the output:\n%s", expected, out.String())
+		}
+	}
+}
+
+func TestDecodeBad(t *testing.T) {
+	data := encoded(t)
+	corrupt := func(offset int, value uint32) []byte {
+		bad := append([]byte(nil), data...)
+		binary.BigEndian.PutUint32(bad[offset:], value)
+		return bad
+	}
+	var header Header
+	binary.Read(bytes.NewReader(data), binary.BigEndian, &header)
+	for name, bad := range map[string][]byte{
+		"short":       data[:HEADER_SIZE-1],
+		"magic":       corrupt(0, 0x1234<<16+VERSION_2),
+		"version":     corrupt(0, MAGIC+3),
+		"dict offset": corrupt(4, HEADER_SIZE-1),
+		"env offset":  corrupt(8, header.JobDictOffset-1),
+		"data offset": corrupt(16, uint32(len(data)+1)),
+		"jobdict":     corrupt(8, header.JobEnvOffset-1),
+		// the zip file ends with its 22 bytes end of central directory
+		"jobhome":     corrupt(int(header.JobDataOffset)-22, 0),
+		"home offset": corrupt(12, header.JobDataOffset+1),
+		"jobenv":      corrupt(12, header.JobEnvOffset+1),
+	} {
+		if _, err := Decode(bytes.NewReader(bad)); err == nil {
+			t.Error("no error for a bad", name)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	jp := testJobPack(t)
+	jp.JobData = []byte("data")
+	var buf bytes.Buffer
+	if err := jp.Encode(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if size, _ := jp.Size(); size != int64(buf.Len()) {
+		t.Error("wrong size", size, buf.Len())
+	}
+	decoded, err := Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decoded.JobData) != "data" || !bytes.Equal(decoded.JobHome, jp.JobHome) {
+		t.Error("wrong jobpack", decoded)
+	}
+	files, _ := decoded.Files()
+	if files[0].Mode()&0100 == 0 {
+		t.Error("worker not executable", files[0].Mode())
+	}
+
+	jp = &JobPack{JobDict: map[string]interface{}{}}
+	buf.Reset()
+	jp.Encode(&buf)
+	if binary.BigEndian.Uint32(buf.Bytes()) != MAGIC+VERSION_1 {
+		t.Error("wrong default version")
+	}
+	if _, err = Decode(&buf); err == nil {
+		t.Error("no error for a job home which is not a zip file")
+	}
+}
+
+func TestPost(t *testing.T) {
+	var length int64
+	var posted *JobPack
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		length = r.ContentLength
+		var err error
+		if posted, err = Decode(r.Body); err != nil {
+			w.Write([]byte(`["error", "bad jobpack"]`))
+			return
+		}
+		w.Write([]byte(`["ok", "gojob@1"]`))
+	}))
+	defer server.Close()
+	jp := testJobPack(t)
+	jobname, err := Post(Options{Master: server.URL + "/"}, jp)
+	if err != nil || jobname != "gojob@1" {
+		t.Fatal("wrong job", jobname, err)
+	}
+	if size, _ := jp.Size(); length != size {
+		t.Error("wrong content length", length, size)
+	}
+	if posted.JobDict["prefix"] != "gojob" {
+		t.Error("wrong jobdict", posted.JobDict)
+	}
+	if _, err = Post(Options{Master: server.URL}, &JobPack{}); err == nil {
+		t.Error("no error for a bad jobpack")
+	}
+}
+
+func TestJobHomeFiles(t *testing.T) {
+	dir := testutil.TempFiles(t, map[string]string{
+		"worker":           "binary",
+		"lookup.txt":       "a b",
+		"data/names.txt":   "names",
+		"data/sub/raw.bin": "raw",
+		"other/job":        "not the worker",
+	})
+	defer os.RemoveAll(dir)
+	worker := filepath.Join(dir, "worker")
+	var err error
+	jp := &JobPack{}
+	jp.JobHome, err = zipit(worker, []string{filepath.Join(dir, "lookup.txt"), filepath.Join(dir, "data")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := jp.Files()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name)
+	}
+	if strings.Join(names, " ") != "job lookup.txt data/names.txt data/sub/raw.bin" {
+		t.Error("wrong files", names)
+	}
+
+	for _, bad := range [][]string{
+		{filepath.Join(dir, "lookup.txt"), filepath.Join(dir, "lookup.txt")},
+		{filepath.Join(dir, "other", "job")},
+		{filepath.Join(dir, "missing")},
+	} {
+		if _, err = zipit(worker, bad); err == nil {
+			t.Error("no error for the files", bad)
+		}
+	}
+}
+
+func TestJobData(t *testing.T) {
+	data, err := jobData(&Options{Data: []byte("raw")})
+	if err != nil || string(data) != "raw" {
+		t.Error("wrong jobdata", string(data), err)
+	}
+	data, err = jobData(&Options{Params: map[string]int{"limit": 3}})
+	if err != nil || string(data) != `{"limit":3}` {
+		t.Error("wrong params", string(data), err)
+	}
+	if _, err = jobData(&Options{Data: []byte("raw"), Params: 1}); err == nil {
+		t.Error("no error for both jobdata and params")
+	}
+	if _, err = jobData(&Options{Params: func() {}}); err == nil {
+		t.Error("no error for bad params")
+	}
+
+	jp := testJobPack(t)
+	jp.JobData = []byte(`{"limit":3}`)
+	var out bytes.Buffer
+	if err = Inspect(&out, jp); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "jobdata: 11 bytes\n{\n  \"limit\": 3\n}\n") {
+		t.Error("wrong params in the output", out.String())
+	}
+}
+
+func TestEffectiveInputs(t *testing.T) {
+	tags := map[string]string{
+		"a":     `[["disco://h/ddfs/a1", "disco://g/ddfs/a1"], ["tag://b"]]`,
+		"b":     `[["disco://h/ddfs/b1"]]`,
+		"log:1": `[["disco://h/ddfs/l1"]]`,
+		"log:2": `[["disco://h/ddfs/l2"]]`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/ddfs/tags/") {
+			w.Write([]byte(`["a", "b", "log:1", "log:2"]`))
+			return
+		}
+		urls, ok := tags[strings.TrimPrefix(r.URL.Path, "/ddfs/tag/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"urls": ` + urls + `}`))
+	}))
+	defer server.Close()
+
+	// the inputs keep their order, and a tag given twice is read twice
+	options := &Options{Master: server.URL, Inputs: []string{"http://x", "tag://log:*", "raw://y", "tag://a", "tag://b"}}
+	inputs, err := getEffectiveInputs(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]string{
+		{"http://x"}, {"disco://h/ddfs/l1"}, {"disco://h/ddfs/l2"}, {"raw://y"},
+		{"disco://h/ddfs/a1", "disco://g/ddfs/a1"}, {"disco://h/ddfs/b1"}, {"disco://h/ddfs/b1"},
+	}
+	if !reflect.DeepEqual(inputs, expected) {
+		t.Error("wrong inputs", inputs)
+	}
+	options.Inputs = []string{"tag://none:*"}
+	if _, err = getEffectiveInputs(options); err == nil {
+		t.Error("no error for a pattern without tags")
+	}
+}
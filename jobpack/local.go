@@ -0,0 +1,95 @@
+package jobpack
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/discoproject/goworker/worker"
+)
+
+// RunLocal compiles the worker and runs the whole job on this machine with
+// the -local flag of the worker, writing the results in the output
+// directory.  The names of the result files are printed by the worker.
+func RunLocal(options Options, output string) error {
+	if options.Type != MAPREDUCE && options.Type != "" {
+		return errors.New("only mapreduce jobs can be run locally")
+	}
+	output, err := filepath.Abs(output)
+	if err != nil {
+		return err
+	}
+	dir, err := ioutil.TempDir("", "jobpack")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	jp, workerExe, job, err := createJobPack(&options, dir)
+	if err != nil {
+		return err
+	}
+	exe, err := filepath.Abs(workerExe)
+	if err != nil {
+		return err
+	}
+	// the worker gets the job home and the jobdata from the jobpack
+	jobfile := filepath.Join(dir, "jobpack")
+	file, err := os.Create(jobfile)
+	if err != nil {
+		return err
+	}
+	err = jp.Encode(file)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	args := []string{worker.LOCAL_FLAG, "-output", output, "-partitions", strconv.Itoa(job.Partitions),
+		"-jobpack", jobfile}
+	// the local worker reads the first replica of every input
+	for _, replicas := range jp.JobDict["input"].([][]string) {
+		input, err := localInput(&options, replicas[0])
+		if err != nil {
+			return err
+		}
+		args = append(args, input)
+	}
+	cmd := exec.Command(exe, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err = cmd.Run(); err != nil {
+		return fmt.Errorf("local job failed: %s", err)
+	}
+	return nil
+}
+
+// localInput returns the url the local worker reads an input from.  The
+// disco:// urls, like those of the blobs of the tags, are files on the nodes
+// of Disco, which are read over HTTP from the nodes on the port of the
+// master instead.
+func localInput(options *Options, input string) (string, error) {
+	if !strings.HasPrefix(input, "disco://") {
+		return input, nil
+	}
+	address, err := url.Parse(input)
+	if err != nil {
+		return "", err
+	}
+	master, err := url.Parse(options.master())
+	if err != nil {
+		return "", err
+	}
+	address.Scheme = "http"
+	if port := master.Port(); port != "" {
+		address.Host = address.Hostname() + ":" + port
+	}
+	return address.String(), nil
+}
@@ -0,0 +1,47 @@
+package jobpack
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/discoproject/goworker/jobutil"
+)
+
+func TestLocalInput(t *testing.T) {
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ddfs/vol0/blob/ab/data$5" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("blob data\n"))
+	}))
+	defer node.Close()
+	port := node.URL[strings.LastIndex(node.URL, ":")+1:]
+
+	options := &Options{Master: "http://master:" + port}
+	input, err := localInput(options, "disco://127.0.0.1/ddfs/vol0/blob/ab/data$5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if input != node.URL+"/ddfs/vol0/blob/ab/data$5" {
+		t.Fatal("wrong input", input)
+	}
+	// the local worker can read it without the data directory of the node
+	rc, err := jobutil.OpenAddress(input, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if data, _ := ioutil.ReadAll(rc); string(data) != "blob data\n" {
+		t.Error("wrong data", string(data))
+	}
+
+	for _, other := range []string{"http://h/a", "raw://data", "/tmp/input"} {
+		if input, err = localInput(options, other); err != nil || input != other {
+			t.Error("input changed", other, input, err)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package jobpack
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/discoproject/goworker/worker"
+)
+
+// ReadJobOptions reads a job config file, a JSON object with the keys of
+// worker.JobOptions.
+func ReadJobOptions(path string) (map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	options := make(map[string]interface{})
+	if err = json.Unmarshal(data, &options); err != nil {
+		return nil, fmt.Errorf("bad job config %s: %s", path, err)
+	}
+	return options, nil
+}
+
+// partitionKeys are the two names of the number of partitions.  Setting
+// one of them in a layer of options replaces both in the layers below.
+var partitionKeys = map[string]string{"partitions": "nr_reduces", "nr_reduces": "partitions"}
+
+// SetJobOption sets an option in a map of job options.  The key of the
+// options of the scheduler is prefixed by "scheduler.", like
+// scheduler.max_cores.
+func SetJobOption(options map[string]interface{}, key string, value interface{}) {
+	if other, ok := partitionKeys[key]; ok {
+		delete(options, other)
+	}
+	keys := strings.Split(key, ".")
+	for _, k := range keys[:len(keys)-1] {
+		nested, ok := options[k].(map[string]interface{})
+		if !ok {
+			nested = make(map[string]interface{})
+			options[k] = nested
+		}
+		options = nested
+	}
+	options[keys[len(keys)-1]] = value
+}
+
+// mergeJobOptions sets the options of src in dst, merging the nested
+// objects.  The number of partitions of src replaces the one of dst, under
+// either name.
+func mergeJobOptions(dst map[string]interface{}, src map[string]interface{}) {
+	for key, other := range partitionKeys {
+		if _, ok := src[key]; ok {
+			delete(dst, other)
+		}
+	}
+	for key, value := range src {
+		if nested, ok := value.(map[string]interface{}); ok {
+			current, isMap := dst[key].(map[string]interface{})
+			if !isMap {
+				current = make(map[string]interface{})
+				dst[key] = current
+			}
+			mergeJobOptions(current, nested)
+		} else {
+			dst[key] = value
+		}
+	}
+}
+
+// description is the description printed by the workers with the
+// -describe flag.
+type description struct {
+	Pipeline [][]interface{}
+	Options  map[string]interface{}
+}
+
+// errNoDescribe is the error of describeWorker for the executables built
+// with older versions of the worker package, which do not know the -describe
+// flag and start a task instead.
+var errNoDescribe = errors.New("the worker cannot describe itself")
+
+// describeWorker runs the worker with the -describe flag to get its pipeline
+// and the options it declares.
+func describeWorker(workerExe string) (*description, error) {
+	path, err := filepath.Abs(workerExe)
+	if err != nil {
+		return nil, err
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command(path, worker.DESCRIBE_FLAG)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		// a task starts with the WORKER message and fails without a
+		// master on its standard input
+		if bytes.HasPrefix(out, []byte("WORKER ")) {
+			return nil, errNoDescribe
+		}
+		return nil, fmt.Errorf("could not describe the worker: %s %s", err, strings.TrimSpace(stderr.String()))
+	}
+	d := new(description)
+	if err = json.Unmarshal(out, d); err != nil {
+		return nil, fmt.Errorf("bad description of the worker: %s", err)
+	}
+	return d, nil
+}
+
+// jobOptions returns the validated options of the job, those declared by
+// the worker overridden by those of options.
+func jobOptions(declared map[string]interface{}, options *Options) (*worker.JobOptions, error) {
+	merged := make(map[string]interface{})
+	mergeJobOptions(merged, declared)
+	mergeJobOptions(merged, options.Job)
+	data, err := json.Marshal(merged)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	result := new(worker.JobOptions)
+	if err = decoder.Decode(result); err != nil {
+		return nil, fmt.Errorf("bad job options: %s", err)
+	}
+	if err = result.Validate(); err != nil {
+		return nil, fmt.Errorf("bad job options: %s", err)
+	}
+	return result, nil
+}
@@ -0,0 +1,108 @@
+package jobpack
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/discoproject/goworker/internal/testutil"
+	"github.com/discoproject/goworker/worker"
+)
+
+func TestJobOptions(t *testing.T) {
+	file, err := ioutil.TempFile("", "job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(`{"nr_reduces": 4, "scheduler": {"max_cores": 8}}`)
+	file.Close()
+
+	overrides, err := ReadJobOptions(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetJobOption(overrides, "scheduler.force_local", true)
+	SetJobOption(overrides, "prefix", "count")
+	declared := map[string]interface{}{
+		"prefix":     "words",
+		"save_info":  "disk",
+		"nr_reduces": 2.0,
+		"scheduler":  map[string]interface{}{"max_cores": 2.0, "force_remote": false},
+	}
+	job, err := jobOptions(declared, &Options{Job: overrides})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := worker.JobOptions{
+		Prefix:     "count",
+		Partitions: 4,
+		NrReduces:  4,
+		SaveInfo:   "disk",
+		Scheduler:  worker.Scheduler{MaxCores: 8, ForceLocal: true},
+	}
+	if *job != expected {
+		t.Error("wrong options", *job)
+	}
+	if declared["scheduler"].(map[string]interface{})["max_cores"] != 2.0 {
+		t.Error("declared options modified", declared)
+	}
+	scheduler := schedulerOptions(job.Scheduler)
+	if !reflect.DeepEqual(scheduler, map[string]interface{}{"max_cores": 8, "force_local": true}) {
+		t.Error("wrong scheduler", scheduler)
+	}
+
+	// an override of either name of the number of partitions replaces
+	// the other one
+	for _, key := range []string{"partitions", "nr_reduces"} {
+		for _, declaredKey := range []string{"partitions", "nr_reduces"} {
+			overrides = map[string]interface{}{"nr_reduces": 2.0}
+			SetJobOption(overrides, key, 8)
+			job, err = jobOptions(map[string]interface{}{declaredKey: 4.0}, &Options{Job: overrides})
+			if err != nil || job.Partitions != 8 || job.NrReduces != 8 {
+				t.Error("wrong partitions for", key, "over", declaredKey, job, err)
+			}
+		}
+	}
+
+	for _, bad := range []map[string]interface{}{
+		{"partitions": 2, "nr_reduces": 3},
+		{"nr_reduce": 2},
+		{"partitions": "2"},
+		{"scheduler": map[string]interface{}{"force_local": true, "force_remote": true}},
+	} {
+		if _, err = jobOptions(nil, &Options{Job: bad}); err == nil {
+			t.Error("no error for", bad)
+		}
+	}
+	if _, err = ReadJobOptions(os.DevNull); err == nil {
+		t.Error("no error for an empty job config")
+	}
+}
+
+func TestCompileWorkerDescribe(t *testing.T) {
+	dir := testutil.TempFiles(t, map[string]string{
+		// an executable which predates -describe starts a task
+		"old": "#!/bin/sh\necho 'WORKER 24 {\"pid\":1,\"version\":\"1.1\"}'\nexit 1\n",
+		"bad": "#!/bin/sh\necho 'force_local and force_remote are both set' >&2\nexit 1\n",
+	})
+	defer os.RemoveAll(dir)
+	old, bad := filepath.Join(dir, "old"), filepath.Join(dir, "bad")
+	os.Chmod(old, 0755)
+	os.Chmod(bad, 0755)
+
+	_, _, job, err := compileWorker(&Options{Worker: old}, dir)
+	if err != nil || job.Partitions != 1 {
+		t.Error("wrong options of an old worker", job, err)
+	}
+	if _, _, _, err = compileWorker(&Options{Worker: old, Type: PIPELINE}, dir); err == nil {
+		t.Error("no error for an old pipeline worker")
+	}
+	_, _, _, err = compileWorker(&Options{Worker: bad}, dir)
+	if err == nil || !strings.Contains(err.Error(), "force_remote are both set") {
+		t.Error("wrong error for a worker with bad options", err)
+	}
+}
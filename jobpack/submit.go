@@ -1,93 +1,53 @@
-package main
+package jobpack
 
 import (
-	"bufio"
-	"bytes"
-	"encoding/json"
-	"fmt"
+	"context"
+	"io"
 
 	"github.com/discoproject/goworker/jobutil"
-
-	"io"
-	"io/ioutil"
-	"log"
-	"net/http"
-	"net/url"
-	"os"
+	"github.com/discoproject/goworker/master"
 )
 
-func submit_job(master string) io.ReadCloser {
-	file, err := os.Open("jp")
-	Check(err)
-	defer file.Close()
-
-	fileinfo, err := file.Stat()
-	Check(err)
-
-	size := fileinfo.Size()
-	data := make([]byte, size)
-	count, err := file.Read(data)
-	Check(err)
-	if count != int(size) {
-		panic("could not read all")
-	}
-
-	discourl := master + "/disco/job/new"
-	var client *http.Client
-	
-	proxy := jobutil.Setting("DISCO_PROXY")
-	if proxy != "" {
-		proxyUrl, err := url.Parse(proxy)
-		Check(err)
-		client = &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)}}
-	} else {
-		client = &http.Client{}
-	}
-	resp, err := client.Post(discourl, "image/jpeg", bytes.NewReader(data))
-	Check(err)
-
-	if resp.StatusCode != http.StatusOK {
-		fmt.Println("bad response: ", resp.Status)
-	}
-
-	return resp.Body
+// masterClient returns a client of the master.
+func masterClient(options *Options) (*master.Client, error) {
+	client := master.NewClient(options.master())
+	var err error
+	client.HTTP, err = jobutil.HTTPClient()
+	return client, err
 }
 
-func Post() {
-	master := "http://" + jobutil.Setting("DISCO_MASTER_HOST") + ":" + jobutil.Setting("DISCO_PORT")
-	response := submit_job(master)
-	defer response.Close()
-	body, err := ioutil.ReadAll(response)
-	Check(err)
-
-	result := make([]interface{}, 2)
-	err = json.Unmarshal(body, &result)
-	Check(err)
-	jobname := result[1].(string)
-	fmt.Println(jobname)
-	get_results(master, jobname)
+// sizedReader is a reader of a known size, which is sent as the
+// Content-Length of the requests.
+type sizedReader struct {
+	io.Reader
+	size int64
 }
 
-func get_results(master string, jobname string) {
-	outputs, err := jobutil.Wait(master, jobname, 20)
-	Check(err)
-	disco_root := jobutil.Setting("DISCO_ROOT")
-	readCloser := jobutil.AddressReader(outputs, disco_root+"/data")
-	defer readCloser.Close()
+func (r *sizedReader) Len() int {
+	return int(r.size)
+}
 
-	reader := bufio.NewReader(readCloser)
-	err = nil
-	line := []byte("")
-	for err == nil {
-		thisRead, isPrefix, thisErr := reader.ReadLine()
-		err = thisErr
-		line = append(line, thisRead...)
-		if !isPrefix {
-			fmt.Println(string(line))
-			line = []byte("")
-		}
+// Post submits the jobpack to the master, and returns the name of the job.
+// The jobpack is encoded while it is sent.
+func Post(options Options, jp *JobPack) (string, error) {
+	client, err := masterClient(&options)
+	if err != nil {
+		return "", err
 	}
-	if err != io.EOF {
-		log.Fatal(err)
+	size, err := jp.Size()
+	if err != nil {
+		return "", err
 	}
+	pr, pw := io.Pipe()
+	// stops the encoding if the request fails before its end
+	defer pr.Close()
+	go func() {
+		pw.CloseWithError(jp.Encode(pw))
+	}()
+	return client.Submit(&sizedReader{pr, size})
+}
+
+// Wait waits for the end of a job and returns its results, see jobutil.Wait.
+func Wait(ctx context.Context, options Options, jobname string, progress jobutil.WaitProgress) ([]string, error) {
+	return jobutil.Wait(ctx, options.master(), jobname, progress)
 }
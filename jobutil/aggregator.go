@@ -31,6 +31,8 @@ func (rcs *ReadClosers) Read(p []byte) (int, error) {
 		if err == io.EOF {
 			rcs.rcs[0].Close()
 			rcs.rcs = rcs.rcs[1:]
+		} else if err != nil {
+			return 0, err
 		} else {
 			log.Print("Got no errors and read nothing")
 		}
@@ -0,0 +1,210 @@
+package jobutil
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+)
+
+// The Disco internal format, also called the chain format, is the format of
+// the records passed between the stages of the Python jobs.  It is a
+// sequence of hunks, each one made of a 14 bytes little-endian header:
+//
+//	version     uint8   128 + CHAIN_VERSION
+//	compressed  uint8   1 if the data is compressed with zlib
+//	checksum    uint32  CRC-32 of the uncompressed data
+//	size        uint64  size of the data
+//
+// and of its data, the pickles of the keys and values of the records, one
+// after the other.
+const (
+	CHAIN_VERSION = 1
+	// CHAIN_HUNK_SIZE is the size of the data of the hunks written by
+	// ChainWriter, before compression, like in Disco.
+	CHAIN_HUNK_SIZE = 1024 * 1024
+	// MAX_HUNK_SIZE is the size of the largest hunk read.
+	MAX_HUNK_SIZE   = 256 * 1024 * 1024
+	chainHeaderSize = 14
+)
+
+type chainHeader struct {
+	Version    uint8
+	Compressed uint8
+	Checksum   uint32
+	Size       uint64
+}
+
+// ChainReader reads the records of the Disco internal format:
+//
+//	r := jobutil.NewChainReader(reader)
+//	for r.Scan() {
+//		// r.Key(), r.Value()
+//	}
+//	if err := r.Err(); err != nil {
+//		...
+//	}
+//
+// The hunks of several outputs can follow each other, as read by
+// AddressReader.
+type ChainReader struct {
+	reader io.Reader
+	hunk   *unpickler
+	key    interface{}
+	value  interface{}
+	err    error
+}
+
+// NewChainReader returns a reader of the records of r.
+func NewChainReader(r io.Reader) *ChainReader {
+	return &ChainReader{reader: r}
+}
+
+// readHunk reads the next hunk.  It returns io.EOF at the end of the input.
+func (r *ChainReader) readHunk() error {
+	var header chainHeader
+	if err := binary.Read(r.reader, binary.LittleEndian, &header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("truncated chain hunk header")
+		}
+		return err
+	}
+	if header.Version < 128 {
+		return fmt.Errorf("not a chain hunk: the data is in an older format")
+	}
+	if header.Version != 128+CHAIN_VERSION {
+		return fmt.Errorf("unsupported chain version: %d", header.Version-128)
+	}
+	if header.Size > MAX_HUNK_SIZE {
+		return fmt.Errorf("chain hunk too large: %d", header.Size)
+	}
+	data := make([]byte, header.Size)
+	if _, err := io.ReadFull(r.reader, data); err != nil {
+		return fmt.Errorf("truncated chain hunk: %s", err)
+	}
+	if header.Compressed != 0 {
+		z, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("bad compressed chain hunk: %s", err)
+		}
+		data, err = ioutil.ReadAll(io.LimitReader(z, MAX_HUNK_SIZE))
+		if err != nil {
+			return fmt.Errorf("bad compressed chain hunk: %s", err)
+		}
+	}
+	if crc32.ChecksumIEEE(data) != header.Checksum {
+		return fmt.Errorf("bad checksum of chain hunk")
+	}
+	r.hunk = newUnpickler(bytes.NewReader(data))
+	return nil
+}
+
+// Scan reads the next record.  It returns false at the end of the input or
+// on an error.
+func (r *ChainReader) Scan() bool {
+	if r.err != nil {
+		return false
+	}
+	for {
+		if r.hunk == nil {
+			if err := r.readHunk(); err != nil {
+				if err != io.EOF {
+					r.err = err
+				}
+				return false
+			}
+		}
+		key, err := r.hunk.load()
+		if err == io.EOF {
+			r.hunk = nil
+			continue
+		}
+		if err == nil {
+			r.value, err = r.hunk.load()
+			if err == io.EOF {
+				err = fmt.Errorf("chain record without a value")
+			}
+		}
+		if err != nil {
+			r.err = err
+			return false
+		}
+		r.key = key
+		return true
+	}
+}
+
+// Key returns the key of the current record.
+func (r *ChainReader) Key() interface{} {
+	return r.key
+}
+
+// Value returns the value of the current record.
+func (r *ChainReader) Value() interface{} {
+	return r.value
+}
+
+// Err returns the first error met reading the records.
+func (r *ChainReader) Err() error {
+	return r.err
+}
+
+// ChainWriter writes records in the Disco internal format.  The records are
+// buffered in hunks, so Flush has to be called after the last one.
+type ChainWriter struct {
+	writer io.Writer
+	hunk   bytes.Buffer
+	// Compress tells whether the hunks are compressed, which is the default.
+	Compress bool
+}
+
+// NewChainWriter returns a writer of records to w.
+func NewChainWriter(w io.Writer) *ChainWriter {
+	return &ChainWriter{writer: w, Compress: true}
+}
+
+// Write writes a record with the pickles of key and value.
+func (w *ChainWriter) Write(key interface{}, value interface{}) error {
+	for _, v := range []interface{}{key, value} {
+		data, err := Pickle(v)
+		if err != nil {
+			return err
+		}
+		w.hunk.Write(data)
+	}
+	if w.hunk.Len() >= CHAIN_HUNK_SIZE {
+		return w.Flush()
+	}
+	return nil
+}
+
+// Flush writes the records buffered in a hunk.
+func (w *ChainWriter) Flush() error {
+	if w.hunk.Len() == 0 {
+		return nil
+	}
+	data := w.hunk.Bytes()
+	header := chainHeader{Version: 128 + CHAIN_VERSION, Checksum: crc32.ChecksumIEEE(data)}
+	if w.Compress {
+		var buf bytes.Buffer
+		z, _ := zlib.NewWriterLevel(&buf, 2)
+		z.Write(data)
+		if err := z.Close(); err != nil {
+			return err
+		}
+		data = buf.Bytes()
+		header.Compressed = 1
+	}
+	header.Size = uint64(len(data))
+	if err := binary.Write(w.writer, binary.LittleEndian, header); err != nil {
+		return err
+	}
+	if _, err := w.writer.Write(data); err != nil {
+		return err
+	}
+	w.hunk.Reset()
+	return nil
+}
@@ -0,0 +1,116 @@
+package jobutil
+
+import (
+	"bytes"
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// written by Python: the records ("word", 1) and ("n", [1.5, None]) pickled
+// with the protocol 1 in a compressed hunk
+const pythonChain = "\x81\x01+\xbf^\xbf+\x00\x00\x00\x00\x00\x00\x00x^\x8b`a``(\xcf/J)d\xd0\xf3f\xd4" +
+	"\x8b`\x04r\xf3\x80\xec\xd8B\x06\rw\xfb\x1f@\x1e\x10\xf8\xa5\xea\x01\x00\xa5d\x07\xed"
+
+func TestChainReaderPython(t *testing.T) {
+	r := NewChainReader(strings.NewReader(pythonChain + pythonChain))
+	var records [][2]interface{}
+	for r.Scan() {
+		records = append(records, [2]interface{}{r.Key(), r.Value()})
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+	record := [2]interface{}{"n", []interface{}{1.5, nil}}
+	if len(records) != 4 || records[0] != [2]interface{}{"word", int64(1)} ||
+		!reflect.DeepEqual(records[1], record) || !reflect.DeepEqual(records[3], record) {
+		t.Error("wrong records", records)
+	}
+}
+
+func TestChainWriter(t *testing.T) {
+	for _, compress := range []bool{true, false} {
+		var buf bytes.Buffer
+		w := NewChainWriter(&buf)
+		w.Compress = compress
+		w.Write("a", 1)
+		w.Write([]byte("b"), map[string]interface{}{"x": Tuple{true, -1.5}})
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		r := NewChainReader(&buf)
+		if !r.Scan() || r.Key() != "a" || r.Value() != int64(1) {
+			t.Error("wrong first record", r.Key(), r.Value(), r.Err())
+		}
+		value := map[interface{}]interface{}{"x": Tuple{true, -1.5}}
+		if !r.Scan() || r.Key() != "b" || !reflect.DeepEqual(r.Value(), value) {
+			t.Error("wrong second record", r.Key(), r.Value(), r.Err())
+		}
+		if r.Scan() || r.Err() != nil {
+			t.Error("wrong end", r.Err())
+		}
+	}
+}
+
+func TestChainReaderErrors(t *testing.T) {
+	bad := []byte(pythonChain)
+	bad[len(bad)-1]++
+	inputs := map[string]string{
+		"checksum":  string(bad),
+		"truncated": pythonChain[:20],
+		"header":    pythonChain[:5],
+		"old":       "3 key 5 value\n",
+	}
+	for name, input := range inputs {
+		r := NewChainReader(strings.NewReader(input))
+		if r.Scan() || r.Err() == nil {
+			t.Error("no error for", name)
+		}
+	}
+}
+
+func TestUnpickle(t *testing.T) {
+	// ("a", b"z", {"k": 2**70}) pickled by Python 3 with the protocol 2
+	data := "\x80\x02X\x01\x00\x00\x00aq\x00c_codecs\nencode\nq\x01X\x01\x00\x00\x00zq\x02X\x06\x00\x00\x00" +
+		"latin1q\x03\x86q\x04Rq\x05}q\x06X\x01\x00\x00\x00kq\x07\x8a\t\x00\x00\x00\x00\x00\x00\x00\x00@s\x87q\x08."
+	v, err := Unpickle([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tuple, ok := v.(Tuple)
+	if !ok || len(tuple) != 3 || tuple[0] != "a" || !bytes.Equal(tuple[1].([]byte), []byte("z")) {
+		t.Fatal("wrong value", v)
+	}
+	long := new(big.Int).Lsh(big.NewInt(1), 70)
+	if n, ok := tuple[2].(map[interface{}]interface{})["k"].(*big.Int); !ok || n.Cmp(long) != 0 {
+		t.Error("wrong long", tuple[2])
+	}
+
+	// Python 2 protocol 0 strings and ints
+	v, err = Unpickle([]byte("(S'it\\'s'\np0\nI42\nI01\ng0\ntp1\n."))
+	if err != nil || !reflect.DeepEqual(v, Tuple{"it's", int64(42), true, "it's"}) {
+		t.Error("wrong protocol 0 value", v, err)
+	}
+	if _, err = Unpickle([]byte("cos\nsystem\n(S'ls'\ntR.")); err == nil {
+		t.Error("no error for an unsupported call")
+	}
+}
+
+func TestPickle(t *testing.T) {
+	values := []interface{}{nil, true, int64(-7), int64(300), int64(1) << 40, 2.5, "s",
+		[]interface{}{int64(1), "x"}, Tuple{}, map[interface{}]interface{}{"k": []interface{}{}}}
+	for _, value := range values {
+		data, err := Pickle(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := Unpickle(data)
+		if err != nil || !reflect.DeepEqual(v, value) {
+			t.Errorf("wrong round trip of %#v: %#v %v", value, v, err)
+		}
+	}
+	if _, err := Pickle(make(chan int)); err == nil {
+		t.Error("no error for a channel")
+	}
+}
@@ -0,0 +1,130 @@
+package jobutil
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// Compression is the format of compressed data.
+type Compression string
+
+const (
+	NoCompression Compression = ""
+	Gzip          Compression = "gzip"
+	Zlib          Compression = "zlib"
+	// Bzip2 can only be read.
+	Bzip2 Compression = "bzip2"
+)
+
+var extensions = map[Compression]string{Gzip: ".gz", Zlib: ".zlib", Bzip2: ".bz2"}
+
+// Extension returns the file extension of the compression, like ".gz".
+func (c Compression) Extension() string {
+	return extensions[c]
+}
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// bzip2 streams start with "BZh", the block size and the magic number of the
+// first block.
+var bzip2Magic = []byte{0x31, 0x41, 0x59, 0x26, 0x53, 0x59}
+
+// DetectCompression returns the compression of data starting with header.
+// The gzip and bzip2 data are detected by their magic bytes, the zlib data,
+// which has none, only by the extension of name.
+func DetectCompression(name string, header []byte) Compression {
+	if bytes.HasPrefix(header, gzipMagic) {
+		return Gzip
+	}
+	if len(header) >= 10 && bytes.HasPrefix(header, []byte("BZh")) &&
+		header[3] >= '1' && header[3] <= '9' && bytes.Equal(header[4:10], bzip2Magic) {
+		return Bzip2
+	}
+	if index := strings.IndexAny(name, "?#"); index != -1 {
+		name = name[:index]
+	}
+	if path.Ext(name) == Zlib.Extension() {
+		return Zlib
+	}
+	return NoCompression
+}
+
+type decompressor struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (d *decompressor) Close() error {
+	var err error
+	for _, closer := range d.closers {
+		if cerr := closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Decompress returns a reader of the decompressed data of rc if it is
+// compressed, detected with DetectCompression, and of the data of rc
+// otherwise.  Closing the result closes rc.
+func Decompress(rc io.ReadCloser, name string) (io.ReadCloser, error) {
+	reader := bufio.NewReader(rc)
+	header, err := reader.Peek(10)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		rc.Close()
+		return nil, err
+	}
+	d := &decompressor{closers: []io.Closer{rc}}
+	switch DetectCompression(name, header) {
+	case Gzip:
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			rc.Close()
+			return nil, fmt.Errorf("bad gzip data in %s: %s", name, err)
+		}
+		d.Reader = gz
+		d.closers = append([]io.Closer{gz}, d.closers...)
+	case Zlib:
+		z, err := zlib.NewReader(reader)
+		if err != nil {
+			rc.Close()
+			return nil, fmt.Errorf("bad zlib data in %s: %s", name, err)
+		}
+		d.Reader = z
+		d.closers = append([]io.Closer{z}, d.closers...)
+	case Bzip2:
+		d.Reader = bzip2.NewReader(reader)
+	default:
+		d.Reader = reader
+	}
+	return d, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// Compress returns a writer which compresses the data written to w.  Closing
+// it flushes the compressed data but does not close w.
+func Compress(w io.Writer, compression Compression) (io.WriteCloser, error) {
+	switch compression {
+	case NoCompression:
+		return nopWriteCloser{w}, nil
+	case Gzip:
+		return gzip.NewWriter(w), nil
+	case Zlib:
+		return zlib.NewWriter(w), nil
+	}
+	return nil, fmt.Errorf("cannot write %s data", compression)
+}
@@ -0,0 +1,105 @@
+package jobutil
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func compress(t *testing.T, compression Compression, data string) []byte {
+	var buf bytes.Buffer
+	w, err := Compress(&buf, compression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte(data))
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func decompress(t *testing.T, name string, data []byte) string {
+	rc, err := Decompress(ioutil.NopCloser(bytes.NewReader(data)), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	result, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(result)
+}
+
+func TestDecompress(t *testing.T) {
+	const data = "hello\nworld\n"
+	if result := decompress(t, "out", compress(t, Gzip, data)); result != data {
+		t.Error("wrong gzip data", result)
+	}
+	if result := decompress(t, "out.zlib", compress(t, Zlib, data)); result != data {
+		t.Error("wrong zlib data", result)
+	}
+	if result := decompress(t, "out.gz", []byte(data)); result != data {
+		t.Error("plain data changed", result)
+	}
+	if result := decompress(t, "empty", nil); result != "" {
+		t.Error("wrong empty data", result)
+	}
+}
+
+func TestDetectCompression(t *testing.T) {
+	bz := []byte("BZh91AY&SY...")
+	if c := DetectCompression("blob", bz); c != Bzip2 {
+		t.Error("bzip2 not detected", c)
+	}
+	if c := DetectCompression("blob", []byte("BZh is text")); c != NoCompression {
+		t.Error("text detected as", c)
+	}
+	if c := DetectCompression("http://host/blob.zlib?x=1", []byte("x")); c != Zlib {
+		t.Error("zlib not detected", c)
+	}
+	if _, err := Compress(ioutil.Discard, Bzip2); err == nil {
+		t.Error("no error for writing bzip2")
+	}
+}
+
+func TestOpenAddressCompressed(t *testing.T) {
+	data := compress(t, Gzip, "a\nb\n")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	defer server.Close()
+	rc, err := OpenAddress(server.URL+"/blob", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	if string(result) != "a\nb\n" {
+		t.Error("wrong http data", string(result))
+	}
+
+	// a dir with a compressed and a plain file
+	dir, _ := ioutil.TempDir("", "compress")
+	defer os.RemoveAll(dir)
+	defer SetKeyValue("HOST", Setting("HOST"))
+	SetKeyValue("HOST", "localhost")
+	ioutil.WriteFile(filepath.Join(dir, "a.gz"), data, 0644)
+	ioutil.WriteFile(filepath.Join(dir, "b"), []byte("c\n"), 0644)
+	index := "0 disco://localhost/disco/a.gz 10\n0 disco://localhost/disco/b 2\n"
+	os.Mkdir(filepath.Join(dir, "localhost"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "localhost", "index"), []byte(index), 0644)
+	if rc, err = OpenAddress("dir://localhost/index", dir); err != nil {
+		t.Fatal(err)
+	}
+	result, _ = ioutil.ReadAll(rc)
+	rc.Close()
+	if string(result) != "a\nb\nc\n" {
+		t.Error("wrong dir data", string(result))
+	}
+}
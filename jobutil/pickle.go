@@ -0,0 +1,660 @@
+package jobutil
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The records of the Disco internal format are pickled by the Python
+// workers.  Only the pickles of the basic Python types are supported, which
+// are decoded as:
+//
+//	None            nil
+//	bool            bool
+//	int, long       int64, or *big.Int if it does not fit
+//	float           float64
+//	str, unicode    string
+//	bytes           []byte
+//	list            []interface{}
+//	tuple           Tuple
+//	dict            map[interface{}]interface{}
+//
+// and encoded in the pickle protocol 1 used by Disco, from the same types and
+// the other integers, strings and maps, slices and structs of these types.
+
+// Tuple is a Python tuple.
+type Tuple []interface{}
+
+var errPickleMark = errors.New("pickle mark not found")
+
+type unpickler struct {
+	reader *bufio.Reader
+	stack  []interface{}
+	marks  []int
+	memo   map[int]interface{}
+}
+
+// Unpickle decodes a pickled value from data.
+func Unpickle(data []byte) (interface{}, error) {
+	return newUnpickler(bytes.NewReader(data)).load()
+}
+
+func newUnpickler(r io.Reader) *unpickler {
+	return &unpickler{reader: bufio.NewReader(r)}
+}
+
+func (u *unpickler) push(v interface{}) {
+	u.stack = append(u.stack, v)
+}
+
+func (u *unpickler) pop() (interface{}, error) {
+	if len(u.stack) == 0 || (len(u.marks) != 0 && len(u.stack) == u.marks[len(u.marks)-1]) {
+		return nil, errors.New("pickle stack underflow")
+	}
+	v := u.stack[len(u.stack)-1]
+	u.stack = u.stack[:len(u.stack)-1]
+	return v, nil
+}
+
+func (u *unpickler) top() (interface{}, error) {
+	if len(u.stack) == 0 {
+		return nil, errors.New("empty pickle stack")
+	}
+	return u.stack[len(u.stack)-1], nil
+}
+
+// popMark returns the values pushed since the last mark.
+func (u *unpickler) popMark() ([]interface{}, error) {
+	if len(u.marks) == 0 {
+		return nil, errPickleMark
+	}
+	mark := u.marks[len(u.marks)-1]
+	u.marks = u.marks[:len(u.marks)-1]
+	values := make([]interface{}, len(u.stack)-mark)
+	copy(values, u.stack[mark:])
+	u.stack = u.stack[:mark]
+	return values, nil
+}
+
+func (u *unpickler) line() (string, error) {
+	line, err := u.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return line[:len(line)-1], nil
+}
+
+func (u *unpickler) bytes(n uint64) ([]byte, error) {
+	if n > MAX_HUNK_SIZE {
+		return nil, fmt.Errorf("pickled value too large: %d", n)
+	}
+	data := make([]byte, n)
+	_, err := io.ReadFull(u.reader, data)
+	return data, err
+}
+
+func (u *unpickler) uint(size int) (uint64, error) {
+	data, err := u.bytes(uint64(size))
+	if err != nil {
+		return 0, err
+	}
+	var n uint64
+	for i := size - 1; i >= 0; i-- {
+		n = n<<8 | uint64(data[i])
+	}
+	return n, nil
+}
+
+// number returns n as an int64 if it fits.
+func number(n *big.Int) interface{} {
+	if n.IsInt64() {
+		return n.Int64()
+	}
+	return n
+}
+
+// decodeLong decodes a little-endian two's complement integer.
+func decodeLong(data []byte) interface{} {
+	n := new(big.Int)
+	for i := len(data) - 1; i >= 0; i-- {
+		n.Lsh(n, 8)
+		n.Or(n, big.NewInt(int64(data[i])))
+	}
+	if len(data) != 0 && data[len(data)-1] >= 0x80 {
+		n.Sub(n, new(big.Int).Lsh(big.NewInt(1), uint(8*len(data))))
+	}
+	return number(n)
+}
+
+func hashable(key interface{}) bool {
+	switch key.(type) {
+	case []interface{}, Tuple, []byte, map[interface{}]interface{}, *big.Int:
+		return false
+	}
+	return true
+}
+
+func (u *unpickler) setItems(values []interface{}) error {
+	v, err := u.top()
+	if err != nil {
+		return err
+	}
+	dict, ok := v.(map[interface{}]interface{})
+	if !ok || len(values)%2 != 0 {
+		return errors.New("bad pickled dict")
+	}
+	for i := 0; i < len(values); i += 2 {
+		if !hashable(values[i]) {
+			return fmt.Errorf("unsupported pickled dict key: %v", values[i])
+		}
+		dict[values[i]] = values[i+1]
+	}
+	return nil
+}
+
+func (u *unpickler) appendItems(values []interface{}) error {
+	v, err := u.pop()
+	if err != nil {
+		return err
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		return errors.New("bad pickled list")
+	}
+	u.push(append(list, values...))
+	return nil
+}
+
+// load decodes the next pickle.  It returns io.EOF if there are none left.
+func (u *unpickler) load() (interface{}, error) {
+	u.stack = u.stack[:0]
+	u.marks = u.marks[:0]
+	u.memo = make(map[int]interface{})
+	first := true
+	for {
+		op, err := u.reader.ReadByte()
+		if err == io.EOF && !first {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		first = false
+		if op == '.' {
+			return u.pop()
+		}
+		if err = u.execute(op); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+}
+
+func (u *unpickler) execute(op byte) error {
+	switch op {
+	case 0x80: // PROTO
+		_, err := u.reader.ReadByte()
+		return err
+	case 0x95: // FRAME
+		_, err := u.uint(8)
+		return err
+	case '(':
+		u.marks = append(u.marks, len(u.stack))
+	case '0':
+		_, err := u.pop()
+		return err
+	case '1':
+		_, err := u.popMark()
+		return err
+	case '2':
+		v, err := u.top()
+		if err != nil {
+			return err
+		}
+		u.push(v)
+	case 'N':
+		u.push(nil)
+	case 0x88:
+		u.push(true)
+	case 0x89:
+		u.push(false)
+	case 'I':
+		line, err := u.line()
+		if err != nil {
+			return err
+		}
+		switch line {
+		case "01":
+			u.push(true)
+		case "00":
+			u.push(false)
+		default:
+			n, ok := new(big.Int).SetString(line, 10)
+			if !ok {
+				return fmt.Errorf("bad pickled int: %q", line)
+			}
+			u.push(number(n))
+		}
+	case 'L':
+		line, err := u.line()
+		if err != nil {
+			return err
+		}
+		n, ok := new(big.Int).SetString(strings.TrimSuffix(line, "L"), 10)
+		if !ok {
+			return fmt.Errorf("bad pickled long: %q", line)
+		}
+		u.push(number(n))
+	case 'J':
+		n, err := u.uint(4)
+		if err != nil {
+			return err
+		}
+		u.push(int64(int32(uint32(n))))
+	case 'K':
+		n, err := u.uint(1)
+		if err != nil {
+			return err
+		}
+		u.push(int64(n))
+	case 'M':
+		n, err := u.uint(2)
+		if err != nil {
+			return err
+		}
+		u.push(int64(n))
+	case 0x8a, 0x8b: // LONG1, LONG4
+		size := 1
+		if op == 0x8b {
+			size = 4
+		}
+		n, err := u.uint(size)
+		if err != nil {
+			return err
+		}
+		data, err := u.bytes(n)
+		if err != nil {
+			return err
+		}
+		u.push(decodeLong(data))
+	case 'F':
+		line, err := u.line()
+		if err != nil {
+			return err
+		}
+		f, err := strconv.ParseFloat(line, 64)
+		if err != nil {
+			return fmt.Errorf("bad pickled float: %q", line)
+		}
+		u.push(f)
+	case 'G':
+		n, err := u.bytes(8)
+		if err != nil {
+			return err
+		}
+		u.push(math.Float64frombits(binary.BigEndian.Uint64(n)))
+	case 'S':
+		line, err := u.line()
+		if err != nil {
+			return err
+		}
+		s, err := strconv.Unquote(pythonQuote(line))
+		if err != nil {
+			return fmt.Errorf("bad pickled string: %q", line)
+		}
+		u.push(s)
+	case 'V':
+		line, err := u.line()
+		if err != nil {
+			return err
+		}
+		s, err := strconv.Unquote(`"` + strings.Replace(line, `"`, `\"`, -1) + `"`)
+		if err != nil {
+			return fmt.Errorf("bad pickled unicode: %q", line)
+		}
+		u.push(s)
+	case 'T', 'U', 'X', 0x8c, 'B', 'C': // strings and bytes with their length
+		size := 4
+		if op == 'U' || op == 0x8c || op == 'C' {
+			size = 1
+		}
+		n, err := u.uint(size)
+		if err != nil {
+			return err
+		}
+		data, err := u.bytes(n)
+		if err != nil {
+			return err
+		}
+		if op == 'B' || op == 'C' {
+			u.push(data)
+		} else {
+			u.push(string(data))
+		}
+	case ']':
+		u.push([]interface{}{})
+	case 'l':
+		values, err := u.popMark()
+		if err != nil {
+			return err
+		}
+		u.push(values)
+	case 'a':
+		v, err := u.pop()
+		if err != nil {
+			return err
+		}
+		return u.appendItems([]interface{}{v})
+	case 'e':
+		values, err := u.popMark()
+		if err != nil {
+			return err
+		}
+		return u.appendItems(values)
+	case ')':
+		u.push(Tuple{})
+	case 't':
+		values, err := u.popMark()
+		if err != nil {
+			return err
+		}
+		u.push(Tuple(values))
+	case 0x85, 0x86, 0x87: // TUPLE1, TUPLE2, TUPLE3
+		n := int(op-0x85) + 1
+		if len(u.stack) < n {
+			return errors.New("pickle stack underflow")
+		}
+		values := append(Tuple(nil), u.stack[len(u.stack)-n:]...)
+		u.stack = u.stack[:len(u.stack)-n]
+		u.push(values)
+	case '}':
+		u.push(make(map[interface{}]interface{}))
+	case 'd':
+		values, err := u.popMark()
+		if err != nil {
+			return err
+		}
+		u.push(make(map[interface{}]interface{}))
+		return u.setItems(values)
+	case 's':
+		value, err := u.pop()
+		if err != nil {
+			return err
+		}
+		key, err := u.pop()
+		if err != nil {
+			return err
+		}
+		return u.setItems([]interface{}{key, value})
+	case 'u':
+		values, err := u.popMark()
+		if err != nil {
+			return err
+		}
+		return u.setItems(values)
+	case 'p', 'q', 'r', 0x94: // PUT, BINPUT, LONG_BINPUT, MEMOIZE
+		v, err := u.top()
+		if err != nil {
+			return err
+		}
+		var index uint64
+		switch op {
+		case 'p':
+			line, err := u.line()
+			if err != nil {
+				return err
+			}
+			if index, err = strconv.ParseUint(line, 10, 32); err != nil {
+				return fmt.Errorf("bad pickle memo index: %q", line)
+			}
+		case 'q':
+			index, err = u.uint(1)
+		case 'r':
+			index, err = u.uint(4)
+		default:
+			index = uint64(len(u.memo))
+		}
+		if err != nil {
+			return err
+		}
+		u.memo[int(index)] = v
+	case 'g', 'h', 'j': // GET, BINGET, LONG_BINGET
+		var index uint64
+		var err error
+		switch op {
+		case 'g':
+			var line string
+			if line, err = u.line(); err == nil {
+				index, err = strconv.ParseUint(line, 10, 32)
+			}
+		case 'h':
+			index, err = u.uint(1)
+		default:
+			index, err = u.uint(4)
+		}
+		if err != nil {
+			return err
+		}
+		v, ok := u.memo[int(index)]
+		if !ok {
+			return fmt.Errorf("pickle memo index not found: %d", index)
+		}
+		u.push(v)
+	case 'c': // GLOBAL
+		module, err := u.line()
+		if err != nil {
+			return err
+		}
+		name, err := u.line()
+		if err != nil {
+			return err
+		}
+		u.push(pickleGlobal{module, name})
+	case 'R': // REDUCE
+		args, err := u.pop()
+		if err != nil {
+			return err
+		}
+		f, err := u.pop()
+		if err != nil {
+			return err
+		}
+		v, err := reduce(f, args)
+		if err != nil {
+			return err
+		}
+		u.push(v)
+	default:
+		return fmt.Errorf("unsupported pickle opcode: 0x%02x", op)
+	}
+	return nil
+}
+
+type pickleGlobal struct {
+	module string
+	name   string
+}
+
+// reduce calls the only function supported by the unpickler: the
+// _codecs.encode(s, "latin1") used by Python 3 to pickle bytes in the
+// protocols before 3.
+func reduce(f interface{}, args interface{}) (interface{}, error) {
+	args1, ok := args.(Tuple)
+	if f != (pickleGlobal{"_codecs", "encode"}) || !ok || len(args1) != 2 {
+		return nil, fmt.Errorf("unsupported pickled object: %v%v", f, args)
+	}
+	s, ok := args1[0].(string)
+	if !ok || (args1[1] != "latin1" && args1[1] != "latin-1") {
+		return nil, fmt.Errorf("unsupported pickled encoding: %v", args)
+	}
+	data := make([]byte, 0, len(s))
+	for _, r := range s {
+		if r > 0xff {
+			return nil, fmt.Errorf("bad latin1 string: %q", s)
+		}
+		data = append(data, byte(r))
+	}
+	return data, nil
+}
+
+// pythonQuote converts a Python string literal to a Go one.
+func pythonQuote(literal string) string {
+	if len(literal) >= 2 && literal[0] == '\'' && literal[len(literal)-1] == '\'' {
+		body := literal[1 : len(literal)-1]
+		body = strings.Replace(body, `\'`, `'`, -1)
+		body = strings.Replace(body, `"`, `\"`, -1)
+		return `"` + body + `"`
+	}
+	return literal
+}
+
+// Pickle encodes v in the pickle protocol 1.
+func Pickle(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := pickle(&buf, reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	buf.WriteByte('.')
+	return buf.Bytes(), nil
+}
+
+func pickleInt(buf *bytes.Buffer, n int64) {
+	switch {
+	case n >= 0 && n < 1<<8:
+		buf.WriteByte('K')
+		buf.WriteByte(byte(n))
+	case n >= 0 && n < 1<<16:
+		buf.WriteByte('M')
+		binary.Write(buf, binary.LittleEndian, uint16(n))
+	case n >= math.MinInt32 && n <= math.MaxInt32:
+		buf.WriteByte('J')
+		binary.Write(buf, binary.LittleEndian, int32(n))
+	default:
+		fmt.Fprintf(buf, "L%dL\n", n)
+	}
+}
+
+func pickleString(buf *bytes.Buffer, s []byte) {
+	if len(s) < 256 {
+		buf.WriteByte('U')
+		buf.WriteByte(byte(len(s)))
+	} else {
+		buf.WriteByte('T')
+		binary.Write(buf, binary.LittleEndian, uint32(len(s)))
+	}
+	buf.Write(s)
+}
+
+func pickle(buf *bytes.Buffer, v reflect.Value) error {
+	if !v.IsValid() {
+		buf.WriteByte('N')
+		return nil
+	}
+	switch x := v.Interface().(type) {
+	case *big.Int:
+		fmt.Fprintf(buf, "L%sL\n", x)
+		return nil
+	case Tuple:
+		buf.WriteString("(")
+		for _, item := range x {
+			if err := pickle(buf, reflect.ValueOf(item)); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('t')
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Interface, reflect.Ptr:
+		if v.IsNil() {
+			buf.WriteByte('N')
+			return nil
+		}
+		return pickle(buf, v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			buf.WriteString("I01\n")
+		} else {
+			buf.WriteString("I00\n")
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		pickleInt(buf, v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if n := v.Uint(); n > math.MaxInt64 {
+			fmt.Fprintf(buf, "L%dL\n", n)
+		} else {
+			pickleInt(buf, int64(n))
+		}
+	case reflect.Float32, reflect.Float64:
+		buf.WriteByte('G')
+		binary.Write(buf, binary.BigEndian, math.Float64bits(v.Float()))
+	case reflect.String:
+		pickleString(buf, []byte(v.String()))
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			data := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(data), v)
+			pickleString(buf, data)
+			break
+		}
+		buf.WriteByte(']')
+		if v.Len() == 0 {
+			break
+		}
+		buf.WriteByte('(')
+		for i := 0; i < v.Len(); i++ {
+			if err := pickle(buf, v.Index(i)); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	case reflect.Map:
+		buf.WriteByte('}')
+		if v.Len() == 0 {
+			break
+		}
+		// sort the keys so that equal maps have equal pickles
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return fmt.Sprint(keys[i].Interface()) < fmt.Sprint(keys[j].Interface())
+		})
+		buf.WriteByte('(')
+		for _, key := range keys {
+			if err := pickle(buf, key); err != nil {
+				return err
+			}
+			if err := pickle(buf, v.MapIndex(key)); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('u')
+	case reflect.Struct:
+		buf.WriteString("}(")
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			if t.Field(i).PkgPath != "" {
+				continue
+			}
+			pickleString(buf, []byte(t.Field(i).Name))
+			if err := pickle(buf, v.Field(i)); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('u')
+	default:
+		return fmt.Errorf("cannot pickle %s", v.Type())
+	}
+	return nil
+}
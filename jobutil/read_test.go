@@ -77,7 +77,10 @@ func TestTagInfo(t *testing.T) {
                "user-data":{}
                }`)
 
-	_, _, urls := tag_info(input)
+	_, _, urls, err := tag_info(input)
+	if err != nil {
+		t.Fatal(err)
+	}
 	if urls[0][0] != "disco://localhost/ddfs/vol0/blob/2b/train-0$574-8412a-e2ff" {
 		t.Error("error decoding. ", urls)
 	}
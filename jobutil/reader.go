@@ -3,33 +3,30 @@ package jobutil
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
-	"net/url"
 	"os"
 	"path"
 	"strings"
 )
 
-func http_reader(address string) io.ReadCloser {
-	var client *http.Client
-	proxy := Setting("DISCO_PROXY")
-	if proxy != "" {
-		proxyUrl, err := url.Parse(proxy)
-		Check(err)
-		client = &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)}}
-	} else {
-		client = &http.Client{}
+func http_reader(address string) (io.ReadCloser, error) {
+	client, err := HTTPClient()
+	if err != nil {
+		return nil, err
 	}
 	resp, err := client.Get(address)
-	Check(err)
+	if err != nil {
+		return nil, err
+	}
 	if resp.StatusCode != http.StatusOK {
-		log.Fatal("bad response: ", resp.Status)
+		resp.Body.Close()
+		return nil, fmt.Errorf("bad response for %s: %s", address, resp.Status)
 	}
-	return resp.Body
+	return resp.Body, nil
 }
 
 func absolute_disco_path(address string, disco_data string) string {
@@ -56,43 +53,53 @@ func (dr *DiscoReader) Close() error {
 	return dr.file.Close()
 }
 
+// getHostAndType returns the host of a disco address and whether it points
+// to the disco or the ddfs data.  The type is empty if the address is too short.
 func getHostAndType(discoAddress string) (string, string) {
 	_, rest := SchemeSplit(discoAddress)
 	list := strings.Split(rest, "/")
 	if len(list) < 2 {
-		log.Fatal("disco path too short", list)
+		return list[0], ""
 	}
 	return list[0], list[1]
 }
 
-func disco_reader(address string, dataDir string) io.ReadCloser {
+func disco_reader(address string, dataDir string) (io.ReadCloser, error) {
 	dr := new(DiscoReader)
 	var path string
 	_, input_type := getHostAndType(address)
-	if input_type == "disco" {
+	switch input_type {
+	case "disco":
 		path = absolute_disco_path(address, dataDir)
-	} else {
+	case "ddfs":
 		path = absolute_ddfs_path(address)
+	default:
+		return nil, errors.New("bad disco address: " + address)
 	}
 	file, err := os.Open(path)
-	Check(err)
+	if err != nil {
+		return nil, err
+	}
 	dr.file = file
-	return dr
+	return dr, nil
 }
 
 type DirReader struct {
 	dirfile    *os.File
 	scanner    *bufio.Scanner
-	file       *os.File
+	file       io.ReadCloser
 	disco_data string
 }
 
 func (dr *DirReader) read_data(p []byte) (int, error) {
 	n, err := dr.file.Read(p)
-	if n == 0 && err == io.EOF {
+	if err == io.EOF {
+		// the decompressors can return the last bytes with io.EOF
 		err = dr.file.Close()
-		Check(err)
 		dr.file = nil
+		if err != nil || n != 0 {
+			return n, err
+		}
 		return dr.Read(p)
 	}
 	return n, err
@@ -102,20 +109,27 @@ func (dr *DirReader) Read(p []byte) (n int, err error) {
 	if dr.file != nil {
 		return dr.read_data(p)
 	}
-	// first read
-	var line string
-	if dr.scanner.Scan() {
-		line = dr.scanner.Text()
-	}
-	if err := dr.scanner.Err(); err != nil {
-		log.Fatal(err)
+	// open the next file of the dir
+	if !dr.scanner.Scan() {
+		if err := dr.scanner.Err(); err != nil {
+			return 0, err
+		}
+		return 0, io.EOF
 	}
+	line := dr.scanner.Text()
 	var address string
 	var label, size int
-	fmt.Sscanf(line, "%d %s %d", &label, &address, &size)
+	if _, err := fmt.Sscanf(line, "%d %s %d", &label, &address, &size); err != nil {
+		return 0, fmt.Errorf("bad dir entry %q: %s", line, err)
+	}
 	path := absolute_disco_path(address, dr.disco_data)
-	dr.file, err = os.Open(path)
-	Check(err)
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	if dr.file, err = Decompress(file, path); err != nil {
+		return 0, err
+	}
 	return dr.read_data(p)
 }
 
@@ -126,16 +140,18 @@ func (dr *DirReader) Close() error {
 	return dr.dirfile.Close()
 }
 
-func dir_reader(address string, dataDir string) io.ReadCloser {
+func dir_reader(address string, dataDir string) (io.ReadCloser, error) {
 	dr := new(DirReader)
 	path := absolute_dir_path(address, dataDir)
 	file, err := os.Open(path)
-	Check(err)
+	if err != nil {
+		return nil, err
+	}
 	dr.dirfile = file
 	dr.scanner = bufio.NewScanner(dr.dirfile)
 	dr.file = nil
 	dr.disco_data = dataDir
-	return dr
+	return dr, nil
 }
 
 func SchemeSplit(url string) (scheme, rest string) {
@@ -186,7 +202,7 @@ func tag_url(tag string) string {
 		"/ddfs/tag/" + tag
 }
 
-func tag_info(str []byte) (int, string, [][]string) {
+func tag_info(str []byte) (int, string, [][]string, error) {
 	type TagInfo struct {
 		Version       int
 		Id            string
@@ -195,43 +211,69 @@ func tag_info(str []byte) (int, string, [][]string) {
 		UserData      map[string]string
 	}
 	var tagInfo TagInfo
-	err := json.Unmarshal(str, &tagInfo)
-	Check(err)
-	return tagInfo.Version, tagInfo.Id, tagInfo.Urls
+	if err := json.Unmarshal(str, &tagInfo); err != nil {
+		return 0, "", nil, err
+	}
+	return tagInfo.Version, tagInfo.Id, tagInfo.Urls, nil
 }
 
-func GetUrls(tag string) [][]string {
+func GetUrls(tag string) ([][]string, error) {
 	url := tag_url(tag)
 	resp, err := http.Get(url)
-	Check(err)
+	if err != nil {
+		return nil, err
+	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		log.Fatal("bad response: ", resp.Status)
+		return nil, fmt.Errorf("bad response for tag %s: %s", tag, resp.Status)
 	}
 	body, err := ioutil.ReadAll(resp.Body)
-	Check(err)
-	_, _, urls := tag_info(body)
-	return urls
+	if err != nil {
+		return nil, err
+	}
+	_, _, urls, err := tag_info(body)
+	return urls, err
+}
+
+// OpenAddress opens a single input address for reading.  Unlike
+// AddressReader, it reports the errors to the caller.  Compressed data is
+// decompressed, see Decompress.
+func OpenAddress(address string, dataDir string) (io.ReadCloser, error) {
+	address = convert_uri(address)
+	scheme, _ := SchemeSplit(address)
+
+	var rc io.ReadCloser
+	var err error
+	switch scheme {
+	case "http":
+		fallthrough
+	case "https":
+		rc, err = http_reader(address)
+	case "disco":
+		rc, err = disco_reader(address, dataDir)
+	case "dir":
+		// the files of the dir are decompressed one by one
+		return dir_reader(address, dataDir)
+	default:
+		return nil, fmt.Errorf("cannot read the input: %s : %s", scheme, address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return Decompress(rc, address)
 }
 
-func AddressReader(addresses []string, dataDir string) io.ReadCloser {
+// AddressReader returns a reader which reads the addresses one after the
+// other.  The addresses are all opened before it returns.
+func AddressReader(addresses []string, dataDir string) (io.ReadCloser, error) {
 	rcs := new(ReadClosers)
 	for _, address := range addresses {
-		address = convert_uri(address)
-		scheme, _ := SchemeSplit(address)
-
-		switch scheme {
-		case "http":
-			fallthrough
-		case "https":
-			rcs.add(http_reader(address))
-		case "disco":
-			rcs.add(disco_reader(address, dataDir))
-		case "dir":
-			rcs.add(dir_reader(address, dataDir))
-		default:
-			log.Fatal("Cannot read the input: ", scheme, " : ", address)
+		rc, err := OpenAddress(address, dataDir)
+		if err != nil {
+			rcs.Close()
+			return nil, err
 		}
+		rcs.add(rc)
 	}
-	return rcs
+	return rcs, nil
 }
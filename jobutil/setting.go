@@ -2,6 +2,7 @@ package jobutil
 
 import (
 	"bufio"
+	"errors"
 	"io"
 	"os"
 	"strings"
@@ -27,32 +28,38 @@ func SetKeyValue(key string, value string) {
 }
 
 // TODO handle more complicated cases like when the value contains =.
-func addLine(line string) {
-	if line == "" {
-		return
+func addLine(line string) error {
+	if strings.Trim(line, " \t") == "" {
+		return nil
 	}
 	if strings.Trim(line, " \t")[0] == '#' {
-		return
+		return nil
 	}
 	list := strings.Split(line, "=")
 	if len(list) != 2 {
-		panic("cannot process line: " + line)
+		return errors.New("cannot process line: " + line)
 	}
 	key := strings.Trim(list[0], " \t\"")
 	value := strings.Trim(list[1], " \t\n\"'")
 	SetKeyValue(key, value)
+	return nil
 }
 
-func addReader(reader io.Reader) {
+func addReader(reader io.Reader) error {
 	scanner := bufio.NewScanner(reader)
 	for scanner.Scan() {
-		addLine(scanner.Text())
+		if err := addLine(scanner.Text()); err != nil {
+			return err
+		}
 	}
+	return scanner.Err()
 }
 
-func AddFile(path string) {
+func AddFile(path string) error {
 	file, err := os.Open(path)
-	Check(err)
-	addReader(file)
-	file.Close()
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return addReader(file)
 }
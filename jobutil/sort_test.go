@@ -2,6 +2,13 @@ package jobutil
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"testing"
 )
@@ -9,7 +16,10 @@ import (
 func TestSorted(t *testing.T) {
 	const input = "aaa\nbbb\nccc\n"
 	reader := strings.NewReader(input)
-	sreader := Sorted(reader)
+	sreader, err := Sorted(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
 	defer sreader.Close()
 	scanner := bufio.NewScanner(sreader)
 	List := []string{"aaa", "bbb", "ccc"}
@@ -19,7 +29,10 @@ func TestSorted(t *testing.T) {
 func TestNotSorted(t *testing.T) {
 	const input = "ccc\nbbb\naaa\n"
 	reader := strings.NewReader(input)
-	sreader := Sorted(reader)
+	sreader, err := Sorted(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
 	defer sreader.Close()
 	scanner := bufio.NewScanner(sreader)
 
@@ -30,7 +43,10 @@ func TestNotSorted(t *testing.T) {
 func TestDifferntSize(t *testing.T) {
 	const input = "c\nbb\naaa\n"
 	reader := strings.NewReader(input)
-	sreader := Sorted(reader)
+	sreader, err := Sorted(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
 	defer sreader.Close()
 	scanner := bufio.NewScanner(sreader)
 
@@ -41,7 +57,10 @@ func TestDifferntSize(t *testing.T) {
 func TestUnicode(t *testing.T) {
 	const input = "a\n\340\n"
 	reader := strings.NewReader(input)
-	sreader := Sorted(reader)
+	sreader, err := Sorted(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
 	defer sreader.Close()
 	scanner := bufio.NewScanner(sreader)
 
@@ -49,6 +68,98 @@ func TestUnicode(t *testing.T) {
 	assert_read(scanner, List, t)
 }
 
+func TestSortedFirstField(t *testing.T) {
+	const input = "b 1\na 2\nb 0\na\t3\nab 1"
+	sreader, err := Sorted(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sreader.Close()
+	data, _ := ioutil.ReadAll(sreader)
+	if string(data) != "a\t3\na 2\nab 1\nb 0\nb 1\n" {
+		t.Errorf("wrong order %q", data)
+	}
+}
+
+func TestSorterSpill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sort")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var input bytes.Buffer
+	expected := make([]string, 1000)
+	for i := range expected {
+		expected[i] = fmt.Sprintf("%04d", (i*7919)%1000)
+		input.WriteString(expected[i] + "\n")
+	}
+	sort.Strings(expected)
+
+	s := &Sorter{Memory: 100, TempDir: dir}
+	sreader, err := s.Sort(&input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) < 2 {
+		t.Error("no spill files", len(files))
+	}
+	assert_read(bufio.NewScanner(sreader), expected, t)
+	if err = sreader.Close(); err != nil {
+		t.Error(err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Error("spill files not removed", len(files))
+	}
+}
+
+// failingReader returns its data, then an error.
+type failingReader struct {
+	data string
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.data == "" {
+		return 0, errors.New("disk error")
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestMergerError(t *testing.T) {
+	m := &merger{s: &Sorter{}}
+	m.sources = []*source{{reader: bufio.NewReader(&failingReader{"b\nc"}), line: []byte("a\n")}}
+	data, err := ioutil.ReadAll(m)
+	if err == nil || err.Error() != "disk error" {
+		t.Error("wrong error", err)
+	}
+	if string(data) != "a\nb\n" {
+		t.Errorf("wrong data %q", data)
+	}
+}
+
+func TestSorterCompare(t *testing.T) {
+	// sort by the number in the second field, in reverse order
+	s := &Sorter{
+		Memory: 8,
+		Key: func(line []byte) []byte {
+			return bytes.Fields(line)[1]
+		},
+		Compare: func(a, b []byte) int {
+			x, _ := strconv.Atoi(string(a))
+			y, _ := strconv.Atoi(string(b))
+			return y - x
+		},
+	}
+	sreader, err := s.Sort(strings.NewReader("a 2\nb 10\nc 1\nd 2\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sreader.Close()
+	assert_read(bufio.NewScanner(sreader), []string{"b 10", "a 2", "d 2", "c 1"}, t)
+}
+
 func assert_read(scanner *bufio.Scanner, List []string, t *testing.T) {
 	for _, word := range List {
 		scanner.Scan()
@@ -105,3 +216,80 @@ func TestGrouperEmptyReader(t *testing.T) {
 		t.Error("should not read!")
 	}
 }
+
+func readGroups(g *KeyGrouper) string {
+	var result []string
+	for g.Scan() {
+		values := make([]string, 0)
+		for g.Next() {
+			values = append(values, string(g.Value()))
+		}
+		result = append(result, fmt.Sprintf("%q:%s", g.Key(), strings.Join(values, ",")))
+	}
+	return strings.Join(result, " ")
+}
+
+func TestKeyGrouper(t *testing.T) {
+	g := NewKeyGrouper(strings.NewReader("a 1\na 2\nb\tx y\nc 3"), FieldKey)
+	if groups := readGroups(g); groups != `"a":1,2 "b":x y "c":3` {
+		t.Error("wrong groups", groups)
+	}
+	if g.Err() != nil {
+		t.Error(g.Err())
+	}
+
+	g = NewKeyGrouper(strings.NewReader("k=1\nk=2\nl\n"), DelimiterKey([]byte("=")))
+	if groups := readGroups(g); groups != `"k":1,2 "l":` {
+		t.Error("wrong groups", groups)
+	}
+}
+
+func TestKeyGrouperEmptyKeys(t *testing.T) {
+	g := NewKeyGrouper(strings.NewReader("\n\na\n\n"), LineKey)
+	if groups := readGroups(g); groups != `"":, "a": "":` {
+		t.Error("wrong groups", groups)
+	}
+}
+
+func TestKeyGrouperSkip(t *testing.T) {
+	g := NewKeyGrouper(strings.NewReader("a 1\na 2\na 3\nb 4\n"), FieldKey)
+	var keys []string
+	for g.Scan() {
+		keys = append(keys, string(g.Key()))
+		if g.Next() && string(g.Value()) != "1" && string(g.Value()) != "4" {
+			t.Error("wrong first value", string(g.Value()))
+		}
+	}
+	if strings.Join(keys, ",") != "a,b" {
+		t.Error("wrong keys", keys)
+	}
+}
+
+func TestKeyGrouperError(t *testing.T) {
+	keyFunc := func(line []byte) ([]byte, []byte, error) {
+		if len(line) == 0 {
+			return nil, nil, fmt.Errorf("empty line")
+		}
+		return line, nil, nil
+	}
+	g := NewKeyGrouper(strings.NewReader("a\n\nb\n"), keyFunc)
+	if groups := readGroups(g); groups != `"a":` {
+		t.Error("wrong groups", groups)
+	}
+	if g.Err() == nil {
+		t.Error("key error not reported")
+	}
+}
+
+func TestGrouperSingleGroup(t *testing.T) {
+	g := Grouper(strings.NewReader("a\na\n"))
+	if !g.Scan() {
+		t.Fatal("could not read")
+	}
+	if word, count := g.Text(); word != "a" || count != 2 {
+		t.Error("wrong group", word, count)
+	}
+	if g.Scan() {
+		t.Error("reading beyond the end?")
+	}
+}
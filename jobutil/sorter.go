@@ -2,40 +2,373 @@ package jobutil
 
 import (
 	"bufio"
-	//"fmt"
+	"bytes"
+	"container/heap"
 	"io"
-	"log"
+	"io/ioutil"
 	"os"
-	"os/exec"
+	"sort"
 )
 
-func put_raw_data_in_file(input io.Reader) string {
-	pwd, err := os.Getwd()
-	Check(err)
-	name := pwd + "/sorted_inputs"
-	sortfile, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
-	defer sortfile.Close()
-	Check(err)
-	// TODO take care of the size
-	_, err = io.Copy(sortfile, input)
-	Check(err)
-	return name
-}
-
-func Sorted(input io.Reader) io.ReadCloser {
-	name := put_raw_data_in_file(input)
-	//TODO this version is only capable of sorting ascii files.  We need a better approach.
-	err := os.Setenv("LC_ALL", "C")
-	Check(err)
-	out, err := exec.Command("sort", "-k", "1,1", "-T", ".", "-S", "10%", "-o", name, name).Output()
+// DEFAULT_SORT_MEMORY is the memory budget of the default sorter.
+const DEFAULT_SORT_MEMORY = 64 * 1024 * 1024
+
+// Sorter sorts the lines of an input with an external merge sort: the lines
+// are sorted in memory in runs of at most Memory bytes, the runs are spilled
+// to temporary files and merged.  The order only depends on the bytes of the
+// lines, so it is the same on every node whatever the locale.
+type Sorter struct {
+	// Memory is the number of bytes of lines sorted in memory before they
+	// are spilled to a file.  DEFAULT_SORT_MEMORY is used if it is 0.
+	Memory int
+	// TempDir is the directory of the spill files, os.TempDir() if empty.
+	TempDir string
+	// Key returns the part of a line the lines are sorted by.  The lines with
+	// equal keys are ordered by their bytes.  The whole line is used if Key
+	// is nil.
+	Key func(line []byte) []byte
+	// Compare compares two keys like bytes.Compare, which is used if Compare
+	// is nil.
+	Compare func(a, b []byte) int
+}
+
+// FirstField returns the first field of a line, up to the first space or
+// tab.  It is the key of the lines sorted with Sorted.
+func FirstField(line []byte) []byte {
+	if index := bytes.IndexAny(line, " \t\n"); index != -1 {
+		return line[:index]
+	}
+	return line
+}
+
+var defaultSorter = &Sorter{Key: FirstField}
+
+// Sorted returns the lines of input sorted by their first field, and the
+// lines with the same first field by their bytes.  Every line of the result
+// ends with a newline.
+func Sorted(input io.Reader) (io.ReadCloser, error) {
+	return defaultSorter.Sort(input)
+}
+
+func (s *Sorter) less(a, b []byte) bool {
+	if s.Key != nil {
+		compare := bytes.Compare
+		if s.Compare != nil {
+			compare = s.Compare
+		}
+		if c := compare(s.Key(a), s.Key(b)); c != 0 {
+			return c < 0
+		}
+	} else if s.Compare != nil {
+		if c := s.Compare(a, b); c != 0 {
+			return c < 0
+		}
+	}
+	return bytes.Compare(a, b) < 0
+}
+
+type lines struct {
+	lines [][]byte
+	s     *Sorter
+}
+
+func (l *lines) Len() int           { return len(l.lines) }
+func (l *lines) Less(i, j int) bool { return l.s.less(l.lines[i], l.lines[j]) }
+func (l *lines) Swap(i, j int)      { l.lines[i], l.lines[j] = l.lines[j], l.lines[i] }
+
+// readLine reads a line and adds a newline to the last line if it has none.
+func readLine(reader *bufio.Reader) ([]byte, error) {
+	line, err := reader.ReadBytes('\n')
+	if err == io.EOF && len(line) != 0 {
+		return append(line, '\n'), nil
+	}
+	return line, err
+}
+
+// Sort returns the lines of input sorted.  The spill files are removed when
+// the result is closed.
+func (s *Sorter) Sort(input io.Reader) (io.ReadCloser, error) {
+	memory := s.Memory
+	if memory <= 0 {
+		memory = DEFAULT_SORT_MEMORY
+	}
+	run := &lines{s: s}
+	size := 0
+	m := &merger{s: s}
+	reader := bufio.NewReader(input)
+	for {
+		line, err := readLine(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			m.Close()
+			return nil, err
+		}
+		run.lines = append(run.lines, line)
+		size += len(line)
+		if size >= memory {
+			if err = m.spill(run); err != nil {
+				m.Close()
+				return nil, err
+			}
+			run.lines = nil
+			size = 0
+		}
+	}
+	sort.Sort(run)
+	if len(m.files) == 0 {
+		return ioutil.NopCloser(bytes.NewReader(bytes.Join(run.lines, nil))), nil
+	}
+	if len(run.lines) != 0 {
+		if err := m.spill(run); err != nil {
+			m.Close()
+			return nil, err
+		}
+	}
+	if err := m.start(); err != nil {
+		m.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// source is a spill file being merged.
+type source struct {
+	reader *bufio.Reader
+	line   []byte
+}
+
+// merger merges the sorted spill files.  It is a heap of the sources by
+// their current line.
+type merger struct {
+	s       *Sorter
+	files   []*os.File
+	sources []*source
+	pending []byte
+	err     error
+}
+
+func (m *merger) Len() int           { return len(m.sources) }
+func (m *merger) Less(i, j int) bool { return m.s.less(m.sources[i].line, m.sources[j].line) }
+func (m *merger) Swap(i, j int)      { m.sources[i], m.sources[j] = m.sources[j], m.sources[i] }
+func (m *merger) Push(x interface{}) { m.sources = append(m.sources, x.(*source)) }
+func (m *merger) Pop() interface{} {
+	last := m.sources[len(m.sources)-1]
+	m.sources = m.sources[:len(m.sources)-1]
+	return last
+}
+
+// spill sorts a run and writes it to a new spill file.
+func (m *merger) spill(run *lines) error {
+	sort.Sort(run)
+	file, err := ioutil.TempFile(m.s.TempDir, "sort_")
 	if err != nil {
-		log.Fatal("sorting input failed: ", out)
+		return err
+	}
+	m.files = append(m.files, file)
+	writer := bufio.NewWriter(file)
+	for _, line := range run.lines {
+		if _, err = writer.Write(line); err != nil {
+			return err
+		}
+	}
+	return writer.Flush()
+}
+
+// start reads the first line of every spill file.
+func (m *merger) start() error {
+	for _, file := range m.files {
+		if _, err := file.Seek(0, 0); err != nil {
+			return err
+		}
+		src := &source{reader: bufio.NewReader(file)}
+		line, err := src.reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if len(line) != 0 {
+			src.line = line
+			m.sources = append(m.sources, src)
+		}
+	}
+	heap.Init(m)
+	return nil
+}
+
+func (m *merger) Read(p []byte) (int, error) {
+	for len(m.pending) == 0 {
+		if m.err != nil {
+			return 0, m.err
+		}
+		if len(m.sources) == 0 {
+			return 0, io.EOF
+		}
+		src := m.sources[0]
+		m.pending = src.line
+		line, err := src.reader.ReadBytes('\n')
+		switch {
+		case err != nil && err != io.EOF:
+			// the partial line read with the error is lost
+			m.err = err
+		case len(line) != 0:
+			src.line = line
+			heap.Fix(m, 0)
+		default:
+			heap.Pop(m)
+		}
+	}
+	n := copy(p, m.pending)
+	m.pending = m.pending[n:]
+	return n, nil
+}
+
+// Close removes the spill files.
+func (m *merger) Close() error {
+	var err error
+	for _, file := range m.files {
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+		os.Remove(file.Name())
+	}
+	m.files = nil
+	m.sources = nil
+	return err
+}
+
+// KeyFunc splits a line, without its newline, into the key it is grouped by
+// and its value.
+type KeyFunc func(line []byte) (key []byte, value []byte, err error)
+
+// FieldKey splits a line at the first space or tab: the key is the first
+// field and the value the rest of the line.  It groups the lines sorted with
+// Sorted.
+func FieldKey(line []byte) ([]byte, []byte, error) {
+	key := FirstField(line)
+	if len(key) == len(line) {
+		return key, nil, nil
+	}
+	return key, line[len(key)+1:], nil
+}
+
+// DelimiterKey returns a KeyFunc which splits the lines at the first
+// delimiter.  The lines without a delimiter are a key without a value.
+func DelimiterKey(delimiter []byte) KeyFunc {
+	return func(line []byte) ([]byte, []byte, error) {
+		index := bytes.Index(line, delimiter)
+		if index == -1 {
+			return line, nil, nil
+		}
+		return line[:index], line[index+len(delimiter):], nil
+	}
+}
+
+// LineKey groups identical lines.  The values are empty.
+func LineKey(line []byte) ([]byte, []byte, error) {
+	return line, nil, nil
+}
+
+// KeyGrouper reads the groups of consecutive lines with the same key, as
+// written by a Sorter with the same key:
+//
+//	g := jobutil.NewKeyGrouper(sorted, jobutil.FieldKey)
+//	for g.Scan() {
+//		for g.Next() {
+//			// g.Key(), g.Value()
+//		}
+//	}
+//	if err := g.Err(); err != nil {
+//		...
+//	}
+//
+// An empty key is a key like the others.
+type KeyGrouper struct {
+	reader  *bufio.Reader
+	keyFunc KeyFunc
+	key     []byte
+	value   []byte
+	// the line read ahead
+	nextKey   []byte
+	nextValue []byte
+	hasNext   bool
+	// pending is true if the line read ahead is a value of the current group
+	pending bool
+	started bool
+	err     error
+}
+
+// NewKeyGrouper returns a grouper of the lines of input by the keys returned
+// by keyFunc.
+func NewKeyGrouper(input io.Reader, keyFunc KeyFunc) *KeyGrouper {
+	return &KeyGrouper{reader: bufio.NewReader(input), keyFunc: keyFunc}
+}
+
+// fill reads the next line ahead.
+func (g *KeyGrouper) fill() {
+	g.hasNext = false
+	line, err := g.reader.ReadBytes('\n')
+	if err != nil && (err != io.EOF || len(line) == 0) {
+		if err != io.EOF {
+			g.err = err
+		}
+		return
+	}
+	if line[len(line)-1] == '\n' {
+		line = line[:len(line)-1]
+	}
+	if g.nextKey, g.nextValue, err = g.keyFunc(line); err != nil {
+		g.err = err
+		return
+	}
+	g.hasNext = true
+}
+
+// Scan moves to the next group, skipping the values left in the current one.
+// It returns false at the end of the input or on an error.
+func (g *KeyGrouper) Scan() bool {
+	if !g.started {
+		g.started = true
+		g.fill()
+	}
+	for g.Next() {
+	}
+	if g.err != nil || !g.hasNext {
+		return false
+	}
+	g.key = g.nextKey
+	g.pending = true
+	return true
+}
+
+// Key returns the key of the current group.
+func (g *KeyGrouper) Key() []byte {
+	return g.key
+}
+
+// Next moves to the next value of the current group.  It returns false when
+// the group has no more values or on an error.
+func (g *KeyGrouper) Next() bool {
+	if g.err != nil || !g.pending {
+		return false
 	}
-	file, err := os.Open(name)
-	Check(err)
-	return file
+	g.value = g.nextValue
+	g.fill()
+	g.pending = g.hasNext && bytes.Equal(g.nextKey, g.key)
+	return true
 }
 
+// Value returns the current value.
+func (g *KeyGrouper) Value() []byte {
+	return g.value
+}
+
+// Err returns the first error met reading the input or extracting the keys.
+func (g *KeyGrouper) Err() error {
+	return g.err
+}
+
+// Group is the result of Grouper.
 type Group interface {
 	Scan() bool
 	Text() (string, int)
@@ -43,46 +376,19 @@ type Group interface {
 }
 
 type group struct {
-	scanner *bufio.Scanner
+	grouper *KeyGrouper
 	line    string
 	count   int
-	current string
-	err     error
-}
-
-func (g *group) init(input io.Reader) {
-	g.scanner = bufio.NewScanner(input)
 }
 
 func (g *group) Scan() bool {
-	count := 1
-	var line string
-	prev := g.current
-	for g.scanner.Scan() {
-		line = g.scanner.Text()
-		if prev == "" {
-			prev = line
-			continue
-		}
-		if line == prev {
-			count++
-		} else {
-			g.current = line
-			g.line = prev
-			g.count = count
-			return true
-		}
+	if !g.grouper.Scan() {
+		return false
 	}
-	if g.current != "" {
-		line = g.current
-		g.current = ""
-		g.line = line
-		g.count = count
-		return true
+	g.line = string(g.grouper.Key())
+	for g.count = 0; g.grouper.Next(); g.count++ {
 	}
-
-	g.err = g.scanner.Err()
-	return false
+	return true
 }
 
 func (g *group) Text() (string, int) {
@@ -90,11 +396,11 @@ func (g *group) Text() (string, int) {
 }
 
 func (g *group) Err() error {
-	return g.err
+	return g.grouper.Err()
 }
 
+// Grouper counts the runs of identical lines of input.  Text returns the
+// line of a run and its number of lines.
 func Grouper(input io.Reader) Group {
-	g := new(group)
-	g.init(input)
-	return g
+	return &group{grouper: NewKeyGrouper(input, LineKey)}
 }
@@ -1,16 +1,20 @@
 package jobutil
 
 import (
-	"bytes"
-	"encoding/json"
-	"errors"
-	"io/ioutil"
+	"context"
+	"fmt"
 	"log"
 	"net/http"
 	"net/url"
 	"time"
+
+	"github.com/discoproject/goworker/master"
 )
 
+// Check terminates the program if err is not nil.  The functions of this
+// package return their errors, Check is a convenience for the programs
+// which submit the jobs.  The Process functions use worker.Check instead,
+// which reports the error to the master.
 func Check(err error) {
 	if err != nil {
 		log.Fatal(err)
@@ -19,85 +23,148 @@ func Check(err error) {
 
 const POLL_INTERVAL = 2000
 
-func encode(jobname string) []byte {
-	list := make([]interface{}, 2)
-	list[0] = POLL_INTERVAL
-	list[1] = []string{jobname}
-	json_jobname, err := json.Marshal(list)
-	Check(err)
-	return json_jobname
+// The delays between the polls of Wait after an error, doubled after every
+// error up to MAX_BACKOFF.
+const (
+	MIN_BACKOFF = 500 * time.Millisecond
+	MAX_BACKOFF = 30 * time.Second
+)
+
+// pollInterval is the least time between two polls of an active job.
+var pollInterval = time.Duration(POLL_INTERVAL) * time.Millisecond
+
+// JobError is the error of a job which did not finish successfully, with its
+// last status, like "dead".
+type JobError struct {
+	Job    string
+	Status string
 }
 
-func decode_response(input []byte) (status string, results []string) {
-	result := make([]interface{}, 1)
-	err := json.Unmarshal(input, &result)
-	Check(err)
-	input0 := result[0].([]interface{})
-	// jobname := input0[0].(string)
-
-	result_list := input0[1].([]interface{})
-	status = result_list[0].(string)
-	inter0 := result_list[1].([]interface{})
-	if len(inter0) == 0 {
-		results = []string{""}
-	} else {
-		inter1 := inter0[0].([]interface{})
-		results = make([]string, len(inter1))
-		for i, item := range inter1 {
-			results[i] = item.(string)
-		}
-	}
-	return
+func (e *JobError) Error() string {
+	return fmt.Sprintf("job %s failed with status: %s", e.Job, e.Status)
+}
+
+// NetworkError is the error of a request which did not reach the master or
+// which got a server error reply.  Wait retries these requests.
+type NetworkError struct {
+	URL string
+	Err error
 }
 
-func get_results(c chan []string, errChan chan error, myurl string, reqBody []byte) {
-	var client *http.Client
-	
+func (e *NetworkError) Error() string {
+	return e.URL + ": " + e.Err.Error()
+}
+
+func (e *NetworkError) Unwrap() error {
+	return e.Err
+}
+
+// WaitProgress is called by Wait after every poll with the status of the
+// job, or with the NetworkError of the poll which will be retried.
+type WaitProgress func(status string, err error)
+
+// HTTPClient returns the client of the requests to the master, which go
+// through the DISCO_PROXY if it is set.
+func HTTPClient() (*http.Client, error) {
 	proxy := Setting("DISCO_PROXY")
-	if proxy != "" {
-		proxyUrl, err := url.Parse(proxy)
-		Check(err)
-		client = &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)}}
-	} else {
-		client = &http.Client{}
+	if proxy == "" {
+		return http.DefaultClient, nil
 	}
-	resp, err := client.Post(myurl, "application/json", bytes.NewReader(reqBody))
-	// TODO only retry on certain errors
+	proxyUrl, err := url.Parse(proxy)
 	if err != nil {
-		time.Sleep(time.Duration(POLL_INTERVAL) * time.Millisecond)
-		get_results(c, errChan, myurl, reqBody)
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		time.Sleep(time.Duration(POLL_INTERVAL) * time.Millisecond)
-		get_results(c, errChan, myurl, reqBody)
+		return nil, err
 	}
-	body, err := ioutil.ReadAll(resp.Body)
+	return &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)}}, nil
+}
+
+// getResults polls the status and the results of a job once.  The results
+// are the first replica of every result of the job.
+func getResults(ctx context.Context, client *master.Client, jobname string) (string, []string, error) {
+	replies, err := client.ResultsContext(ctx, pollInterval, jobname)
 	if err != nil {
-		errChan <- err
+		return "", nil, err
+	}
+	for _, reply := range replies {
+		if reply.Name != jobname {
+			continue
+		}
+		results := make([]string, 0, len(reply.Results))
+		for _, replicas := range reply.Results {
+			if len(replicas) > 0 {
+				results = append(results, replicas[0])
+			}
+		}
+		return reply.Status, results, nil
 	}
-	status, inputs := decode_response(body)
-	if status == "active" {
-		time.Sleep(time.Duration(POLL_INTERVAL) * time.Millisecond)
-		get_results(c, errChan, myurl, reqBody)
+	return "", nil, fmt.Errorf("no results for job %s", jobname)
+}
 
-	} else if status == "ready" {
-		c <- inputs
+// retryable tells if the poll which failed with err may succeed later: the
+// requests which did not reach the master, and those refused by the master
+// with a server error.  A client error, like the 404 of an unknown job, is
+// permanent.
+func retryable(err error) bool {
+	switch e := err.(type) {
+	case *url.Error:
+		return true
+	case *master.Error:
+		return e.StatusCode >= http.StatusInternalServerError
 	}
+	return false
 }
 
-func Wait(master string, jobname string, timeout time.Duration) ([]string, error) {
-	encoded := encode(jobname)
-	url := master + "/disco/ctrl/get_results"
-	c := make(chan []string)
-	errChan := make(chan error)
-	go get_results(c, errChan, url, encoded)
-	select {
-	case <-time.After(timeout * time.Second):
-		return nil, errors.New("time out")
-	case outputs := <-c:
-		return outputs, nil
-	case err := <-errChan:
+// Wait polls the master until the job is finished and returns its results.
+// The polls which fail with a transport error or a server error of the master
+// are retried with an exponential backoff, until ctx is done; the other errors
+// are returned as they are.  A job which does not finish successfully returns
+// a JobError, and ctx returns its own error when it is done first.  progress,
+// if not nil, is called after every poll.
+func Wait(ctx context.Context, masterURL string, jobname string, progress WaitProgress) ([]string, error) {
+	httpClient, err := HTTPClient()
+	if err != nil {
 		return nil, err
 	}
+	client := master.NewClient(masterURL)
+	client.HTTP = httpClient
+	backoff := MIN_BACKOFF
+	for {
+		start := time.Now()
+		status, results, err := getResults(ctx, client, jobname)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if err != nil && retryable(err) {
+			err = &NetworkError{masterURL + "/disco/ctrl/get_results", err}
+		}
+		if progress != nil {
+			progress(status, err)
+		}
+
+		var delay time.Duration
+		if _, ok := err.(*NetworkError); ok {
+			delay = backoff
+			if backoff *= 2; backoff > MAX_BACKOFF {
+				backoff = MAX_BACKOFF
+			}
+		} else if err != nil {
+			return nil, err
+		} else if status == "ready" {
+			return results, nil
+		} else if status != "active" {
+			return nil, &JobError{jobname, status}
+		} else {
+			// the master already waits for the job to finish up to
+			// POLL_INTERVAL before it replies
+			delay = pollInterval - time.Since(start)
+			backoff = MIN_BACKOFF
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
 }
@@ -1,44 +1,127 @@
 package jobutil
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/discoproject/goworker/master"
 )
 
-func TestEncodeOne(t *testing.T) {
-	result := encode("gojob")
-	if string(result) != "[2000,[\"gojob\"]]" {
-		t.Error("bad_encoding", string(result))
+func SettingTest(t *testing.T) {
+	SetKeyValue("hello", "world")
+	val := Setting("hello")
+	if val != "world" {
+		t.Error("wrong value", val)
+	}
+}
+
+// fakeResults replies to the polls of Wait with the given replies, an empty
+// one being a server error and "404" a client error.
+func fakeResults(replies ...string) (*httptest.Server, *int) {
+	polls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reply := replies[len(replies)-1]
+		if polls < len(replies) {
+			reply = replies[polls]
+		}
+		polls++
+		if reply == "" {
+			http.Error(w, "restarting", http.StatusServiceUnavailable)
+			return
+		}
+		if reply == "404" {
+			http.Error(w, "unknown job", http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(reply))
+	}))
+	return server, &polls
+}
+
+func TestWait(t *testing.T) {
+	defer func(interval time.Duration) { pollInterval = interval }(pollInterval)
+	pollInterval = time.Millisecond
+	server, _ := fakeResults(`[["gojob",["active",[]]]]`, "", `[["gojob",["ready",[["disco://output"]]]]]`)
+	defer server.Close()
+
+	var statuses []string
+	progress := func(status string, err error) {
+		if _, ok := err.(*NetworkError); ok {
+			status = "error"
+		}
+		statuses = append(statuses, status)
+	}
+	results, err := Wait(context.Background(), server.URL, "gojob", progress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0] != "disco://output" {
+		t.Error("wrong results", results)
+	}
+	if strings.Join(statuses, " ") != "active error ready" {
+		t.Error("wrong progress", statuses)
 	}
 }
 
-func TestDecodeActive(t *testing.T) {
-	input := "[[\"gojob@576:17a3d:e4372\",[\"active\",[]]]]"
-	status, result := decode_response([]byte(input))
-	if status != "active" {
-		t.Error("status is not correct", status)
+func TestWaitDead(t *testing.T) {
+	server, _ := fakeResults(`[["gojob",["dead",[]]]]`)
+	defer server.Close()
+	_, err := Wait(context.Background(), server.URL, "gojob", nil)
+	if e, ok := err.(*JobError); !ok || e.Status != "dead" || e.Job != "gojob" {
+		t.Error("wrong error", err)
 	}
+}
 
-	if result[0] != "" {
-		t.Error("should not find any input", result[0])
+func TestWaitCancel(t *testing.T) {
+	server, polls := fakeResults("")
+	defer server.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), MIN_BACKOFF*2)
+	defer cancel()
+	_, err := Wait(ctx, server.URL, "gojob", nil)
+	if err != context.DeadlineExceeded {
+		t.Error("wrong error", err)
+	}
+	// the polls at 0 and MIN_BACKOFF, the next one is after the deadline
+	if *polls != 2 {
+		t.Error("wrong number of polls", *polls)
+	}
+	if _, err = Wait(ctx, "http://localhost:0", "gojob", nil); err != context.DeadlineExceeded {
+		t.Error("wrong error for a done context", err)
 	}
 }
 
-func TestDecodeReady(t *testing.T) {
-	input := "[[\"gojob@576:175ca:c4eb\",[\"ready\",[[\"disco://input\"]]]]]"
-	status, result := decode_response([]byte(input))
-	if status != "ready" {
-		t.Error("status is not correct", status)
+func TestWaitResults(t *testing.T) {
+	server, _ := fakeResults(`[["gojob",["ready",[["disco://a","disco://b"],"disco://c",[]]]]]`)
+	defer server.Close()
+	results, err := Wait(context.Background(), server.URL, "gojob", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(results, " ") != "disco://a disco://c" {
+		t.Error("wrong results", results)
 	}
+}
 
-	if result[0] != "disco://input" {
-		t.Error("should not find any input", result[0])
+func TestWaitNotFound(t *testing.T) {
+	server, polls := fakeResults("404")
+	defer server.Close()
+	_, err := Wait(context.Background(), server.URL, "gojob", nil)
+	if e, ok := err.(*master.Error); !ok || e.StatusCode != http.StatusNotFound {
+		t.Error("wrong error", err)
+	}
+	if *polls != 1 {
+		t.Error("client error retried", *polls)
 	}
 }
 
-func SettingTest(t *testing.T) {
-	SetKeyValue("hello", "world")
-	val := Setting("hello")
-	if val != "world" {
-		t.Error("wrong value", val)
+func TestWaitMissingJob(t *testing.T) {
+	server, _ := fakeResults(`[]`)
+	defer server.Close()
+	if _, err := Wait(context.Background(), server.URL, "gojob", nil); err == nil {
+		t.Error("no error for a missing job")
 	}
 }
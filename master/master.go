@@ -0,0 +1,340 @@
+// Package master is a client of the HTTP API of a Disco master, to submit
+// jobs and manage them:
+//
+//	client := master.NewClient("http://localhost:8989")
+//	name, err := client.Submit(jobpack)
+//	...
+//	info, err := client.JobInfo(name)
+package master
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The status of the jobs.
+const (
+	ACTIVE = "active"
+	READY  = "ready"
+	DEAD   = "dead"
+)
+
+// Client is a client of the API of a Disco master.
+type Client struct {
+	// Master is the url of the master, like http://localhost:8989.
+	Master string
+	// HTTP is the client used for the requests.
+	HTTP *http.Client
+}
+
+// NewClient returns a client of the master at the given url.
+func NewClient(master string) *Client {
+	return &Client{Master: strings.TrimRight(master, "/"), HTTP: http.DefaultClient}
+}
+
+// Error is the error of a request which failed on the master.  StatusCode
+// is the HTTP status of the reply, which is 200 when the master reports the
+// error in its reply, like for the jobs it refuses.
+type Error struct {
+	URL        string
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %d %s", e.URL, e.StatusCode, e.Message)
+}
+
+// Job is an entry of the list of jobs.
+type Job struct {
+	// Time is the start time of the job, like 2013/06/21 10:15:02.
+	Time   string
+	Status string
+	Name   string
+}
+
+// UnmarshalJSON decodes the [time, status, name] lists of the master.
+func (j *Job) UnmarshalJSON(data []byte) error {
+	return decodeList(data, &j.Time, &j.Status, &j.Name)
+}
+
+// JobInfo is the information of a job.
+type JobInfo struct {
+	Timestamp string `json:"timestamp"`
+	// Status is ACTIVE, READY or DEAD.
+	Status string `json:"active"`
+	// Mapi and Redi are the numbers of pending, waiting, done and failed
+	// tasks of the map and reduce stages.
+	Mapi   []int  `json:"mapi"`
+	Redi   []int  `json:"redi"`
+	Reduce bool   `json:"reduce"`
+	Worker string `json:"worker"`
+	Owner  string `json:"owner"`
+	// Hosts are the nodes which ran tasks of the job.
+	Hosts []string `json:"hosts"`
+	// Inputs and Results are as sent by the master, their format depends
+	// on the type of the job.
+	Inputs  []interface{} `json:"inputs"`
+	Results []interface{} `json:"results"`
+}
+
+// Event is an event of a job.
+type Event struct {
+	Time    string
+	Host    string
+	Message string
+}
+
+// UnmarshalJSON decodes the [time, host, message] lists of the master.
+func (e *Event) UnmarshalJSON(data []byte) error {
+	return decodeList(data, &e.Time, &e.Host, &e.Message)
+}
+
+// ReplicaSet is a result of a job, the urls of its replicas.
+type ReplicaSet []string
+
+// UnmarshalJSON accepts a single url as well as a list of urls.
+func (r *ReplicaSet) UnmarshalJSON(data []byte) error {
+	var address string
+	if err := json.Unmarshal(data, &address); err == nil {
+		*r = ReplicaSet{address}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(r))
+}
+
+// Results are the status and the results of a job.  The results are only
+// known when the job is READY.
+type Results struct {
+	Name    string
+	Status  string
+	Results []ReplicaSet
+}
+
+// UnmarshalJSON decodes the [name, [status, results]] lists of the master.
+func (r *Results) UnmarshalJSON(data []byte) error {
+	var status json.RawMessage
+	if err := decodeList(data, &r.Name, &status); err != nil {
+		return err
+	}
+	return decodeList(status, &r.Status, &r.Results)
+}
+
+// decodeList decodes a JSON list into the values, one per element.
+func decodeList(data []byte, values ...interface{}) error {
+	var list []json.RawMessage
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	if len(list) != len(values) {
+		return fmt.Errorf("expected a list of %d elements: %s", len(values), data)
+	}
+	for i, value := range values {
+		if err := json.Unmarshal(list[i], value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bodySize returns the number of bytes left to read in the body of a
+// request, which has a Len method, like bytes.Reader, or is a file.  The
+// master does not accept the requests sent in chunks, whose size is unknown.
+func bodySize(body io.Reader) (int64, error) {
+	switch r := body.(type) {
+	case interface{ Len() int }:
+		return int64(r.Len()), nil
+	case interface{ Stat() (os.FileInfo, error) }:
+		info, err := r.Stat()
+		if err != nil {
+			return 0, err
+		}
+		if !info.Mode().IsRegular() {
+			return 0, fmt.Errorf("unknown size of %s", info.Name())
+		}
+		var offset int64
+		if seeker, ok := body.(io.Seeker); ok {
+			if offset, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+				return 0, err
+			}
+		}
+		return info.Size() - offset, nil
+	}
+	return 0, errors.New("unknown size of the request, the body needs a Len method")
+}
+
+// request sends a request and returns the body of the reply.  The requests
+// which do not reach the master, or whose reply cannot be read, fail with a
+// *url.Error, and those refused by the master with an *Error.
+func (c *Client) request(ctx context.Context, method string, path string, contentType string,
+	body io.Reader) ([]byte, error) {
+	address := c.Master + path
+	var size int64
+	if body != nil {
+		var err error
+		if size, err = bodySize(body); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest(method, address, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	// NewRequest only knows the size of the readers of the bytes and
+	// strings packages, and an empty body would be sent in chunks
+	req.ContentLength = size
+	if size == 0 && body != nil {
+		req.Body = http.NoBody
+	}
+	resp, err := c.HTTP.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, &url.Error{Op: method, URL: address, Err: err}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, &Error{address, resp.StatusCode, strings.TrimSpace(string(data))}
+	}
+	return data, nil
+}
+
+// get sends a GET request and decodes the JSON reply into result.
+func (c *Client) get(path string, result interface{}) error {
+	data, err := c.request(context.Background(), "GET", path, "", nil)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(data, result); err != nil {
+		return fmt.Errorf("bad reply from %s: %s", c.Master+path, err)
+	}
+	return nil
+}
+
+// post sends the JSON encoding of value and decodes the JSON reply into
+// result, unless it is nil.
+func (c *Client) post(ctx context.Context, path string, value interface{}, result interface{}) error {
+	body, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	data, err := c.request(ctx, "POST", path, "application/json", bytes.NewReader(body))
+	if err != nil || result == nil {
+		return err
+	}
+	if err = json.Unmarshal(data, result); err != nil {
+		return fmt.Errorf("bad reply from %s: %s", c.Master+path, err)
+	}
+	return nil
+}
+
+// Submit submits a jobpack and returns the name of the new job.  The
+// jobpack is sent with its size, so the reader has to be a file or to have a
+// Len method, like bytes.Reader.
+func (c *Client) Submit(jobpack io.Reader) (string, error) {
+	data, err := c.request(context.Background(), "POST", "/disco/job/new", "application/octet-stream", jobpack)
+	if err != nil {
+		return "", err
+	}
+	var status, message string
+	if err = decodeList(data, &status, &message); err != nil {
+		return "", fmt.Errorf("bad reply from %s: %s", c.Master+"/disco/job/new", err)
+	}
+	if status != "ok" {
+		return "", &Error{c.Master + "/disco/job/new", http.StatusOK, message}
+	}
+	return message, nil
+}
+
+// Jobs returns the list of the jobs, the most recent first.
+func (c *Client) Jobs() ([]Job, error) {
+	var jobs []Job
+	err := c.get("/disco/ctrl/joblist", &jobs)
+	return jobs, err
+}
+
+// JobInfo returns the information of a job.
+func (c *Client) JobInfo(job string) (*JobInfo, error) {
+	info := new(JobInfo)
+	if err := c.get("/disco/ctrl/jobinfo?name="+url.QueryEscape(job), info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Events returns the events of a job from the given offset in its event
+// log, 0 for all of them, and the offset of the next events.
+func (c *Client) Events(job string, offset int) ([]Event, int, error) {
+	path := "/disco/ctrl/rawevents?name=" + url.QueryEscape(job) + "&offset=" + strconv.Itoa(offset)
+	data, err := c.request(context.Background(), "GET", path, "", nil)
+	if err != nil {
+		return nil, offset, err
+	}
+	// the last line can be incomplete while the event is written
+	if end := bytes.LastIndexByte(data, '\n'); end >= 0 {
+		data = data[:end+1]
+	} else {
+		data = nil
+	}
+	events := make([]Event, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, len(data)+1)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var event Event
+		if err = json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return nil, offset, fmt.Errorf("bad event of job %s: %s", job, err)
+		}
+		events = append(events, event)
+	}
+	return events, offset + len(data), nil
+}
+
+// Results returns the status and the results of jobs.  The master waits up
+// to timeout for one of the jobs to finish before replying.
+func (c *Client) Results(timeout time.Duration, jobs ...string) ([]Results, error) {
+	return c.ResultsContext(context.Background(), timeout, jobs...)
+}
+
+// ResultsContext is Results with a context, which stops the request when it
+// is done.
+func (c *Client) ResultsContext(ctx context.Context, timeout time.Duration, jobs ...string) ([]Results, error) {
+	var results []Results
+	request := []interface{}{int(timeout / time.Millisecond), jobs}
+	err := c.post(ctx, "/disco/ctrl/get_results", request, &results)
+	return results, err
+}
+
+// Kill stops a job.  Its results and its data are kept.
+func (c *Client) Kill(job string) error {
+	return c.post(context.Background(), "/disco/ctrl/kill_job", job, nil)
+}
+
+// Clean removes a job from the master, keeping its data on the nodes.
+func (c *Client) Clean(job string) error {
+	return c.post(context.Background(), "/disco/ctrl/clean_job", job, nil)
+}
+
+// Purge removes a job and all of its data.
+func (c *Client) Purge(job string) error {
+	return c.post(context.Background(), "/disco/ctrl/purge_job", job, nil)
+}
@@ -0,0 +1,203 @@
+package master
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeMaster replies to the requests with canned replies and records them.
+type fakeMaster struct {
+	sync.Mutex
+	server   *httptest.Server
+	replies  map[string]string
+	requests map[string]string
+	// lengths are the Content-Length of the requests, -1 for the chunked
+	// ones.
+	lengths map[string]int64
+}
+
+func newFakeMaster(replies map[string]string) *fakeMaster {
+	m := &fakeMaster{replies: replies, requests: make(map[string]string), lengths: make(map[string]int64)}
+	m.server = httptest.NewServer(m)
+	return m
+}
+
+func (m *fakeMaster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.Lock()
+	defer m.Unlock()
+	body, _ := ioutil.ReadAll(r.Body)
+	m.requests[r.URL.Path] = r.Method + " " + r.URL.RawQuery + " " + string(body)
+	m.lengths[r.URL.Path] = r.ContentLength
+	reply, ok := m.replies[r.URL.Path]
+	if !ok {
+		http.Error(w, "unknown job", http.StatusNotFound)
+		return
+	}
+	w.Write([]byte(reply))
+}
+
+func TestSubmit(t *testing.T) {
+	m := newFakeMaster(map[string]string{"/disco/job/new": `["ok", "gojob@576:17a3d:e4372"]`})
+	defer m.server.Close()
+	c := NewClient(m.server.URL + "/")
+	name, err := c.Submit(strings.NewReader("jobpack"))
+	if err != nil || name != "gojob@576:17a3d:e4372" {
+		t.Error("wrong job", name, err)
+	}
+	if m.requests["/disco/job/new"] != "POST  jobpack" {
+		t.Error("wrong request", m.requests["/disco/job/new"])
+	}
+
+	m.replies["/disco/job/new"] = `["error", "invalid jobpack"]`
+	_, err = c.Submit(strings.NewReader("jobpack"))
+	if e, ok := err.(*Error); !ok || e.Message != "invalid jobpack" {
+		t.Error("wrong error", err)
+	}
+	m.replies["/disco/job/new"] = `not json`
+	if _, err = c.Submit(strings.NewReader("jobpack")); err == nil {
+		t.Error("no error for a bad reply")
+	}
+}
+
+func TestSubmitLength(t *testing.T) {
+	m := newFakeMaster(map[string]string{"/disco/job/new": `["ok", "gojob@1"]`})
+	defer m.server.Close()
+	c := NewClient(m.server.URL)
+
+	file, err := ioutil.TempFile("", "jobpack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("header jobpack")
+	file.Seek(int64(len("header ")), io.SeekStart)
+	if _, err = c.Submit(file); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	if m.lengths["/disco/job/new"] != 7 || m.requests["/disco/job/new"] != "POST  jobpack" {
+		t.Error("wrong request", m.lengths["/disco/job/new"], m.requests["/disco/job/new"])
+	}
+
+	if _, err = c.Submit(bytes.NewReader([]byte("jobpack!"))); err != nil || m.lengths["/disco/job/new"] != 8 {
+		t.Error("wrong length", m.lengths["/disco/job/new"], err)
+	}
+	delete(m.requests, "/disco/job/new")
+	if _, err = c.Submit(io.MultiReader(strings.NewReader("jobpack"))); err == nil {
+		t.Error("no error for a jobpack of unknown size")
+	}
+	if _, sent := m.requests["/disco/job/new"]; sent {
+		t.Error("jobpack of unknown size sent")
+	}
+}
+
+func TestJobs(t *testing.T) {
+	m := newFakeMaster(map[string]string{
+		"/disco/ctrl/joblist": `[["2013/06/21 10:15:02", "active", "b"], ["2013/06/21 10:12:00", "dead", "a"]]`,
+		"/disco/ctrl/jobinfo": `{"timestamp": "2013/06/21 10:15:02", "active": "ready", "mapi": [0, 0, 2, 1],
+			"redi": [0, 0, 1, 0], "reduce": true, "worker": "./job", "owner": "me@host",
+			"hosts": ["h1"], "inputs": ["http://input"], "results": ["disco://h1/out"]}`,
+	})
+	defer m.server.Close()
+	c := NewClient(m.server.URL)
+	jobs, err := c.Jobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Job{{"2013/06/21 10:15:02", ACTIVE, "b"}, {"2013/06/21 10:12:00", DEAD, "a"}}
+	if !reflect.DeepEqual(jobs, expected) {
+		t.Error("wrong jobs", jobs)
+	}
+	info, err := c.JobInfo("b@1:2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Status != READY || !reflect.DeepEqual(info.Mapi, []int{0, 0, 2, 1}) || !info.Reduce || info.Hosts[0] != "h1" {
+		t.Error("wrong job info", info)
+	}
+	if m.requests["/disco/ctrl/jobinfo"] != "GET name=b%401%3A2 " {
+		t.Error("wrong request", m.requests["/disco/ctrl/jobinfo"])
+	}
+	delete(m.replies, "/disco/ctrl/jobinfo")
+	if _, err = c.JobInfo("missing"); err == nil || err.(*Error).StatusCode != http.StatusNotFound {
+		t.Error("wrong error for a missing job", err)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	m := newFakeMaster(map[string]string{
+		"/disco/ctrl/rawevents": `["2013/06/21 10:15:02", "master", "New job"]` + "\n" +
+			`["2013/06/21 10:15:03", "h1", "Done"]` + "\n" + `["2013/06/21`,
+	})
+	defer m.server.Close()
+	c := NewClient(m.server.URL)
+	events, offset, err := c.Events("a", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[1] != (Event{"2013/06/21 10:15:03", "h1", "Done"}) {
+		t.Error("wrong events", events)
+	}
+	if offset != 10+len(m.replies["/disco/ctrl/rawevents"])-len(`["2013/06/21`) {
+		t.Error("wrong offset", offset)
+	}
+	if m.requests["/disco/ctrl/rawevents"] != "GET name=a&offset=10 " {
+		t.Error("wrong request", m.requests["/disco/ctrl/rawevents"])
+	}
+}
+
+func TestResults(t *testing.T) {
+	m := newFakeMaster(map[string]string{
+		"/disco/ctrl/get_results": `[["a", ["ready", ["disco://h/1", ["disco://h/2", "disco://g/2"]]]], ["b", ["active", []]]]`,
+	})
+	defer m.server.Close()
+	c := NewClient(m.server.URL)
+	results, err := c.Results(2*time.Second, "a", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Results{
+		{"a", READY, []ReplicaSet{{"disco://h/1"}, {"disco://h/2", "disco://g/2"}}},
+		{"b", ACTIVE, []ReplicaSet{}},
+	}
+	if !reflect.DeepEqual(results, expected) {
+		t.Error("wrong results", results)
+	}
+	var request []interface{}
+	json.Unmarshal([]byte(strings.SplitN(m.requests["/disco/ctrl/get_results"], " ", 3)[2]), &request)
+	if !reflect.DeepEqual(request, []interface{}{2000.0, []interface{}{"a", "b"}}) {
+		t.Error("wrong request", request)
+	}
+}
+
+func TestKill(t *testing.T) {
+	m := newFakeMaster(map[string]string{
+		"/disco/ctrl/kill_job":  `"ok"`,
+		"/disco/ctrl/clean_job": `"ok"`,
+		"/disco/ctrl/purge_job": `"ok"`,
+	})
+	defer m.server.Close()
+	c := NewClient(m.server.URL)
+	for path, action := range map[string]func(string) error{
+		"/disco/ctrl/kill_job":  c.Kill,
+		"/disco/ctrl/clean_job": c.Clean,
+		"/disco/ctrl/purge_job": c.Purge,
+	} {
+		if err := action("a"); err != nil {
+			t.Error(path, err)
+		}
+		if m.requests[path] != `POST  "a"` {
+			t.Error("wrong request", path, m.requests[path])
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package worker
+
+import (
+	"io"
+
+	"github.com/discoproject/goworker/jobutil"
+)
+
+// ChainOutput writes records in the Disco internal format, which the
+// Python stages of a job can read.  The data of the format is not made of
+// lines, so when the output has several partitions the records have to be
+// written with a ChainOutput rather than with the Write method of the Writer:
+//
+//	out := worker.NewChainOutput(writer)
+//	out.Write("word", 1)
+//	...
+//	if err := out.Flush(); err != nil {
+//		worker.Error("%s", err)
+//	}
+//
+// The records are read with jobutil.NewChainReader.
+type ChainOutput struct {
+	writer io.Writer
+	chains map[int]*jobutil.ChainWriter
+}
+
+// NewChainOutput returns an output of records to writer, usually the Writer
+// of the task.
+func NewChainOutput(writer io.Writer) *ChainOutput {
+	return &ChainOutput{writer, make(map[int]*jobutil.ChainWriter)}
+}
+
+// Write writes a record to the partition of its key, computed by the
+// Partitioner of the Writer from the pickle of the key.
+func (o *ChainOutput) Write(key interface{}, value interface{}) error {
+	label := ALL_LABELS
+	if w, ok := o.writer.(*Writer); ok && w.partitions > 1 {
+		pickled, err := jobutil.Pickle(key)
+		if err != nil {
+			return err
+		}
+		label = w.partitioner(pickled, w.partitions)
+	}
+	chain, ok := o.chains[label]
+	if !ok {
+		writer := o.writer
+		if label != ALL_LABELS {
+			writer = o.writer.(*Writer).Label(label)
+		}
+		chain = jobutil.NewChainWriter(writer)
+		o.chains[label] = chain
+	}
+	return chain.Write(key, value)
+}
+
+// Flush writes the records left in the buffers.  It must be called after
+// the last record.
+func (o *ChainOutput) Flush() error {
+	for _, chain := range o.chains {
+		if err := chain.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
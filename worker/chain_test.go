@@ -0,0 +1,48 @@
+package worker
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/discoproject/goworker/jobutil"
+)
+
+func TestChainOutput(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "chain")
+	defer os.RemoveAll(dir)
+	w := newWriter(dir, "out_", 3)
+	out := NewChainOutput(w)
+	keys := []string{"a", "b", "c", "d", "e", "f"}
+	for i, key := range keys {
+		if err := out.Write(key, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := out.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	found := 0
+	for label, data := range readOutputs(t, w) {
+		r := jobutil.NewChainReader(bytes.NewReader([]byte(data)))
+		for r.Scan() {
+			pickled, _ := jobutil.Pickle(r.Key())
+			if HashPartitioner(pickled, 3) != label {
+				t.Error("record in the wrong partition", r.Key(), label)
+			}
+			if keys[r.Value().(int64)] != r.Key() {
+				t.Error("wrong record", r.Key(), r.Value())
+			}
+			found++
+		}
+		if err := r.Err(); err != nil {
+			t.Error(err)
+		}
+	}
+	if found != len(keys) {
+		t.Error("records lost", found)
+	}
+}
@@ -0,0 +1,103 @@
+package worker
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// MAX_MESSAGE_SIZE is the largest payload accepted from the master.
+const MAX_MESSAGE_SIZE = 100 * 1024 * 1024
+
+// Conn is a connection to the master speaking the worker protocol.  Every
+// message is framed as "NAME SIZE PAYLOAD\n" where PAYLOAD is SIZE bytes of
+// JSON.  A worker started by Disco talks to the master over its standard
+// input and output, but a Conn can be created over any reader and writer.
+type Conn struct {
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+// NewConn returns a connection which reads the messages of the master from r
+// and writes the messages of the worker to w.
+func NewConn(r io.Reader, w io.Writer) *Conn {
+	return &Conn{bufio.NewReader(r), bufio.NewWriter(w)}
+}
+
+// Send sends a message with the JSON encoding of payload.
+func (c *Conn) Send(name string, payload interface{}) error {
+	enc, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("could not encode %s: %s", name, err)
+	}
+	if _, err = fmt.Fprintf(c.writer, "%s %d %s\n", name, len(enc), enc); err != nil {
+		return err
+	}
+	debug("send", fmt.Sprintf("%s %d %s", name, len(enc), enc))
+	return c.writer.Flush()
+}
+
+// readField reads the bytes up to the next space.
+func (c *Conn) readField(what string) (string, error) {
+	field, err := c.reader.ReadString(' ')
+	if err != nil {
+		return "", fmt.Errorf("could not read message %s: %s", what, err)
+	}
+	return field[:len(field)-1], nil
+}
+
+// Recv receives a message and returns its name and its JSON payload.
+func (c *Conn) Recv() (string, []byte, error) {
+	name, err := c.readField("name")
+	if err != nil {
+		return "", nil, err
+	}
+	if name == "" {
+		return "", nil, fmt.Errorf("message without a name")
+	}
+	for _, r := range name {
+		if (r < 'A' || r > 'Z') && r != '_' {
+			return "", nil, fmt.Errorf("bad message name: %q", name)
+		}
+	}
+	field, err := c.readField("size")
+	if err != nil {
+		return "", nil, err
+	}
+	size, err := strconv.Atoi(field)
+	if err != nil || size < 0 || size > MAX_MESSAGE_SIZE {
+		return "", nil, fmt.Errorf("bad size for %s message: %q", name, field)
+	}
+	payload := make([]byte, size)
+	if _, err = io.ReadFull(c.reader, payload); err != nil {
+		return "", nil, fmt.Errorf("could not read %s message: %s", name, err)
+	}
+	if end, err := c.reader.ReadByte(); err != nil || end != '\n' {
+		return "", nil, fmt.Errorf("%s message not terminated by a newline", name)
+	}
+	debug("recv", fmt.Sprintf("%s %d %s", name, size, payload))
+	return name, payload, nil
+}
+
+// expect_ok reads the reply of the master to a message which can only be
+// answered with OK.
+func (c *Conn) expect_ok(name string) error {
+	status, payload, err := c.Recv()
+	if err != nil {
+		return err
+	}
+	if status != "OK" {
+		return fmt.Errorf("unexpected reply to %s: %s %s", name, status, payload)
+	}
+	return nil
+}
+
+// request sends a message and checks that the master answered with OK.
+func (c *Conn) request(name string, payload interface{}) error {
+	if err := c.Send(name, payload); err != nil {
+		return err
+	}
+	return c.expect_ok(name)
+}
@@ -0,0 +1,73 @@
+package worker
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestConnSend(t *testing.T) {
+	var out bytes.Buffer
+	c := NewConn(strings.NewReader(""), &out)
+	if err := c.Send("INPUT", []interface{}{"exclude", []int{1, 2}}); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "INPUT 17 [\"exclude\",[1,2]]\n" {
+		t.Error("wrong message", out.String())
+	}
+}
+
+func TestConnRecv(t *testing.T) {
+	c := NewConn(strings.NewReader("OK 4 \"ok\"\nTASK 2 {}\n"), nil)
+	name, payload, err := c.Recv()
+	if err != nil || name != "OK" || string(payload) != "\"ok\"" {
+		t.Error("bad message", name, string(payload), err)
+	}
+	// the second message is not lost in a buffer
+	name, payload, err = c.Recv()
+	if err != nil || name != "TASK" || string(payload) != "{}" {
+		t.Error("bad message", name, string(payload), err)
+	}
+	if _, _, err = c.Recv(); err == nil {
+		t.Error("read past the end")
+	}
+}
+
+func TestConnRecvBad(t *testing.T) {
+	messages := []string{
+		"",
+		"OK",
+		"ok 4 \"ok\"\n",
+		"OK x \"ok\"\n",
+		"OK -1 \"ok\"\n",
+		"OK 1000000000 \"ok\"\n",
+		"OK 4 \"ok\"",
+		"OK 3 \"ok\"\n",
+		"OK 5 \"ok\"\n",
+	}
+	for _, message := range messages {
+		c := NewConn(strings.NewReader(message), nil)
+		if name, payload, err := c.Recv(); err == nil {
+			t.Errorf("no error for %q: %s %s", message, name, payload)
+		}
+	}
+}
+
+func TestConnPipe(t *testing.T) {
+	masterReader, workerWriter := io.Pipe()
+	workerReader, masterWriter := io.Pipe()
+	worker := NewConn(workerReader, workerWriter)
+	master := NewConn(masterReader, masterWriter)
+
+	go func() {
+		name, _, err := master.Recv()
+		if err != nil || name != "PING" {
+			t.Error("bad message", name, err)
+		}
+		master.Send("OK", "ok")
+	}()
+	if err := worker.request("PING", ""); err != nil {
+		t.Error("ping failed", err)
+	}
+}
@@ -0,0 +1,210 @@
+package worker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/discoproject/goworker/jobutil"
+)
+
+// INPUT_POLL_INTERVAL is the time in milliseconds the worker waits before
+// asking the master again for inputs that are not available yet.
+const INPUT_POLL_INTERVAL = 1000
+
+// inputStream is the reader handed to the Process functions.  It reads the
+// inputs of the task one after the other, and when it runs out of inputs
+// while the master has not sent all of them yet ("more"), it keeps polling
+// the master for new inputs, excluding the ones already consumed.
+type inputStream struct {
+	request  func(exclude []int) (string, []*Input, error)
+	open     func(location string) (io.ReadCloser, error)
+	inputErr func(id int, failed []int) (string, []byte, error)
+	sleep    func(d time.Duration)
+	pending  []*Input
+	consumed []int
+	seen     map[int]bool
+	done     bool
+	polled   bool
+	current  io.ReadCloser
+	err      error
+	// label is the label of the inputs of the task, or ALL_LABELS.
+	label int
+}
+
+func newInputStream(conn *Conn, dataDir string) *inputStream {
+	s := new(inputStream)
+	s.request = conn.request_input
+	s.open = func(location string) (io.ReadCloser, error) {
+		return jobutil.OpenAddress(location, dataDir)
+	}
+	s.inputErr = conn.send_input_err
+	s.sleep = time.Sleep
+	s.seen = make(map[int]bool)
+	s.label = ALL_LABELS
+	return s
+}
+
+// poll requests the inputs from the master and queues the ones which are
+// ready and have not been seen before.  It returns the number of new inputs.
+// An input which failed fails the task, which the master can retry, instead
+// of being left out of the data given to the Process function.
+func (s *inputStream) poll() (int, error) {
+	var exclude []int
+	if s.polled {
+		exclude = s.consumed
+	}
+	flag, inputs, err := s.request(exclude)
+	if err != nil {
+		return 0, err
+	}
+	s.polled = true
+	s.done = flag == "done"
+
+	count := 0
+	for _, input := range inputs {
+		if s.seen[input.id] || input.status == "busy" {
+			continue
+		}
+		if s.label != ALL_LABELS && input.label != ALL_LABELS && input.label != s.label {
+			// Inputs of other groups are not read but still excluded.
+			s.seen[input.id] = true
+			s.consumed = append(s.consumed, input.id)
+			continue
+		}
+		if input.status != "ok" {
+			return count, &retryError{fmt.Errorf("input %d is %s", input.id, input.status)}
+		}
+		s.seen[input.id] = true
+		s.pending = append(s.pending, input)
+		count++
+	}
+	// Inputs which are still busy will be sent again by the master.
+	for _, input := range inputs {
+		if input.status == "busy" {
+			s.done = false
+		}
+	}
+	return count, nil
+}
+
+// next returns the next available input, polling the master and waiting
+// for new inputs as long as the master has more of them.  It returns nil
+// when all the inputs have been consumed.
+func (s *inputStream) next() (*Input, error) {
+	for len(s.pending) == 0 {
+		if s.polled && s.done {
+			return nil, nil
+		}
+		wait := s.polled
+		count, err := s.poll()
+		if err != nil {
+			return nil, err
+		}
+		if count == 0 && !s.done && wait {
+			s.sleep(time.Duration(INPUT_POLL_INTERVAL) * time.Millisecond)
+		}
+	}
+	input := s.pending[0]
+	s.pending = s.pending[1:]
+	s.consumed = append(s.consumed, input.id)
+	return input, nil
+}
+
+// all consumes all the inputs of the task without reading them.
+func (s *inputStream) all() ([]*Input, error) {
+	inputs := make([]*Input, 0)
+	for {
+		input, err := s.next()
+		if err != nil || input == nil {
+			return inputs, err
+		}
+		inputs = append(inputs, input)
+	}
+}
+
+// openInput opens the first replica of the input which can be read.  When
+// none of them can be read, the master is informed with INPUT_ERR and
+// decides whether the worker should retry with other replicas, wait and
+// retry, or give up on the task.
+func (s *inputStream) openInput(input *Input) (io.ReadCloser, error) {
+	replicas := input.replicas
+	for {
+		failed := make([]int, 0)
+		for _, replica := range replicas {
+			rc, err := s.open(replica.location)
+			if err == nil {
+				input.replica_id = replica.id
+				input.replica_location = replica.location
+				return rc, nil
+			}
+			debug("input_err", fmt.Sprintln(input.id, replica.id, err))
+			failed = append(failed, replica.id)
+		}
+
+		reply, payload, err := s.inputErr(input.id, failed)
+		if err != nil {
+			return nil, err
+		}
+		switch reply {
+		case "RETRY":
+			if replicas, err = process_replicas(payload); err != nil {
+				return nil, err
+			}
+		case "WAIT":
+			var seconds int
+			if err := json.Unmarshal(payload, &seconds); err != nil {
+				return nil, fmt.Errorf("bad WAIT reply: %s", payload)
+			}
+			s.sleep(time.Duration(seconds) * time.Second)
+			replicas = input.replicas
+		default:
+			return nil, &retryError{fmt.Errorf("cannot read input %d: %s", input.id, reply)}
+		}
+	}
+}
+
+// Read reads the inputs one after the other.  The errors are kept so that
+// the worker can report them even if the Process function ignored them.
+func (s *inputStream) Read(p []byte) (int, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	for {
+		if s.current == nil {
+			input, err := s.next()
+			if err != nil {
+				s.err = err
+				return 0, err
+			}
+			if input == nil {
+				return 0, io.EOF
+			}
+			s.current, s.err = s.openInput(input)
+			if s.err != nil {
+				return 0, s.err
+			}
+		}
+		n, err := s.current.Read(p)
+		if err == io.EOF {
+			s.current.Close()
+			s.current = nil
+			err = nil
+		} else if err != nil {
+			s.err = &retryError{err}
+		}
+		if n != 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+func (s *inputStream) Close() error {
+	if s.current != nil {
+		err := s.current.Close()
+		s.current = nil
+		return err
+	}
+	return nil
+}
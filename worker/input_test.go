@@ -0,0 +1,227 @@
+package worker
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeMaster struct {
+	replies    []string
+	excludes   [][]int
+	errReplies []string
+	errors     [][]int
+}
+
+func (fm *fakeMaster) request(exclude []int) (string, []*Input, error) {
+	fm.excludes = append(fm.excludes, append([]int(nil), exclude...))
+	reply := fm.replies[0]
+	if len(fm.replies) > 1 {
+		fm.replies = fm.replies[1:]
+	}
+	return process_input([]byte(reply))
+}
+
+func (fm *fakeMaster) inputErr(id int, failed []int) (string, []byte, error) {
+	fm.errors = append(fm.errors, append([]int{id}, failed...))
+	reply := fm.errReplies[0]
+	fm.errReplies = fm.errReplies[1:]
+	fields := strings.SplitN(reply, " ", 2)
+	if len(fields) == 1 {
+		return fields[0], []byte(`""`), nil
+	}
+	return fields[0], []byte(fields[1]), nil
+}
+
+// fakeStream returns an input stream which reads the replica locations as
+// data, except for the locations starting with "bad" which cannot be read.
+func fakeStream(fm *fakeMaster) (*inputStream, *int) {
+	sleeps := 0
+	s := newInputStream(nil, "")
+	s.request = fm.request
+	s.inputErr = fm.inputErr
+	s.open = func(location string) (io.ReadCloser, error) {
+		if strings.HasPrefix(location, "bad") {
+			return nil, errors.New("cannot open " + location)
+		}
+		return ioutil.NopCloser(strings.NewReader(location + "\n")), nil
+	}
+	s.sleep = func(time.Duration) { sleeps++ }
+	return s, &sleeps
+}
+
+func TestInputStreamDone(t *testing.T) {
+	fm := &fakeMaster{replies: []string{
+		`["done",[[0,"ok",0,[[0,"a"]]],[1,"ok",0,[[0,"b"]]]]]`,
+	}}
+	s, sleeps := fakeStream(fm)
+	data, err := ioutil.ReadAll(s)
+	if err != nil {
+		t.Error("read failed", err)
+	}
+	if string(data) != "a\nb\n" {
+		t.Error("wrong data", string(data))
+	}
+	if len(fm.excludes) != 1 || *sleeps != 0 {
+		t.Error("unexpected polling", fm.excludes, *sleeps)
+	}
+}
+
+func TestInputStreamMore(t *testing.T) {
+	fm := &fakeMaster{replies: []string{
+		`["more",[[0,"ok",0,[[0,"a"]]],[1,"busy",0,[[0,"b"]]]]]`,
+		`["more",[[1,"busy",0,[[0,"b"]]]]]`,
+		`["more",[[1,"ok",0,[[0,"b"]]]]]`,
+		`["done",[[2,"ok",0,[[0,"c"]]]]]`,
+	}}
+	s, sleeps := fakeStream(fm)
+	data, err := ioutil.ReadAll(s)
+	if err != nil {
+		t.Error("read failed", err)
+	}
+	if string(data) != "a\nb\nc\n" {
+		t.Error("wrong data", string(data))
+	}
+	expected := [][]int{nil, {0}, {0}, {0, 1}}
+	if !reflect.DeepEqual(fm.excludes, expected) {
+		t.Error("wrong excludes", fm.excludes)
+	}
+	if *sleeps != 1 {
+		t.Error("wrong number of waits", *sleeps)
+	}
+}
+
+func TestInputStreamFailed(t *testing.T) {
+	fm := &fakeMaster{replies: []string{
+		`["done",[[0,"ok",0,[[0,"a"]]],[1,"failed",0,[[0,"b"]]]]]`,
+	}}
+	s, _ := fakeStream(fm)
+	_, err := ioutil.ReadAll(s)
+	if _, ok := err.(*retryError); !ok || err.Error() != "input 1 is failed" {
+		t.Error("wrong error for a failed input", err)
+	}
+
+	// the failed inputs of other groups are not read
+	fm = &fakeMaster{replies: []string{
+		`["done",[[0,"ok",0,[[0,"a"]]],[1,"failed",1,[[0,"b"]]]]]`,
+	}}
+	s, _ = fakeStream(fm)
+	s.label = 0
+	data, err := ioutil.ReadAll(s)
+	if err != nil || string(data) != "a\n" {
+		t.Error("wrong data", string(data), err)
+	}
+}
+
+func TestInputStreamAll(t *testing.T) {
+	fm := &fakeMaster{replies: []string{
+		`["more",[[0,"ok",0,[[0,"a"]]]]]`,
+		`["done",[[1,"ok",1,[[0,"b"]]]]]`,
+	}}
+	s, _ := fakeStream(fm)
+	inputs, err := s.all()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inputs) != 2 {
+		t.Fatal("wrong number of inputs", len(inputs))
+	}
+	if inputs[1].label != 1 || inputs[1].replica_location != "b" {
+		t.Error("bad input", inputs[1])
+	}
+}
+
+func TestInputStreamReplicas(t *testing.T) {
+	fm := &fakeMaster{replies: []string{
+		`["done",[[0,"ok",0,[[0,"bad0"],[1,"a"]]]]]`,
+	}}
+	s, _ := fakeStream(fm)
+	data, err := ioutil.ReadAll(s)
+	if err != nil {
+		t.Error("read failed", err)
+	}
+	if string(data) != "a\n" {
+		t.Error("wrong data", string(data))
+	}
+	if len(fm.errors) != 0 {
+		t.Error("unexpected INPUT_ERR", fm.errors)
+	}
+}
+
+func TestInputStreamRetry(t *testing.T) {
+	fm := &fakeMaster{
+		replies:    []string{`["done",[[3,"ok",0,[[0,"bad0"],[1,"bad1"]]]]]`},
+		errReplies: []string{`WAIT 1`, `RETRY [[2,"bad2"],[3,"a"]]`},
+	}
+	s, sleeps := fakeStream(fm)
+	data, err := ioutil.ReadAll(s)
+	if err != nil {
+		t.Error("read failed", err)
+	}
+	if string(data) != "a\n" {
+		t.Error("wrong data", string(data))
+	}
+	expected := [][]int{{3, 0, 1}, {3, 0, 1}}
+	if !reflect.DeepEqual(fm.errors, expected) {
+		t.Error("wrong INPUT_ERR messages", fm.errors)
+	}
+	if *sleeps != 1 {
+		t.Error("did not wait", *sleeps)
+	}
+}
+
+func TestInputStreamFail(t *testing.T) {
+	fm := &fakeMaster{
+		replies:    []string{`["done",[[0,"ok",0,[[0,"a"]]],[1,"ok",0,[[5,"bad"]]]]]`},
+		errReplies: []string{`FAIL`},
+	}
+	s, _ := fakeStream(fm)
+	data, err := ioutil.ReadAll(s)
+	if _, ok := err.(*retryError); !ok {
+		t.Error("no retryable error for a failed input", err)
+	}
+	if string(data) != "a\n" {
+		t.Error("wrong data", string(data))
+	}
+	if !reflect.DeepEqual(fm.errors, [][]int{{1, 5}}) {
+		t.Error("wrong INPUT_ERR messages", fm.errors)
+	}
+}
+
+func TestInputStreamLabel(t *testing.T) {
+	fm := &fakeMaster{replies: []string{
+		`["more",[[0,"ok",1,[[0,"a"]]],[1,"ok",2,[[0,"b"]]]]]`,
+		`["done",[[2,"ok","all",[[0,"c"]]]]]`,
+	}}
+	s, _ := fakeStream(fm)
+	s.label = 1
+	data, err := ioutil.ReadAll(s)
+	if err != nil {
+		t.Error("read failed", err)
+	}
+	if string(data) != "a\nc\n" {
+		t.Error("wrong data", string(data))
+	}
+	if !reflect.DeepEqual(fm.excludes[1], []int{1, 0}) {
+		t.Error("inputs of other labels not excluded", fm.excludes)
+	}
+}
+
+func TestInputStreamProtocolError(t *testing.T) {
+	fm := &fakeMaster{replies: []string{`["done",[[0,"ok",0]]]`}}
+	s, _ := fakeStream(fm)
+	_, err := ioutil.ReadAll(s)
+	if err == nil {
+		t.Fatal("no error for a bad reply")
+	}
+	if _, ok := err.(*retryError); ok {
+		t.Error("protocol error should not be retried", err)
+	}
+	if s.err != err {
+		t.Error("error not kept", s.err)
+	}
+}
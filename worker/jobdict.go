@@ -0,0 +1,69 @@
+package worker
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+)
+
+const (
+	JOBPACK_MAGIC      = 0xd5c0 << 16
+	JOBPACK_MAGIC_MASK = 0xffff << 16
+)
+
+// read_offsets opens a jobpack and reads the offsets of its header.
+func read_offsets(jobfile string) ([5]uint32, *os.File, error) {
+	var offsets [5]uint32
+	file, err := os.Open(jobfile)
+	if err != nil {
+		return offsets, nil, err
+	}
+	if err = binary.Read(file, binary.BigEndian, &offsets); err != nil {
+		file.Close()
+		return offsets, nil, err
+	}
+	if offsets[0]&JOBPACK_MAGIC_MASK != JOBPACK_MAGIC {
+		file.Close()
+		return offsets, nil, errors.New("bad jobpack magic: " + jobfile)
+	}
+	for i := 2; i < len(offsets); i++ {
+		if offsets[i] < offsets[i-1] {
+			file.Close()
+			return offsets, nil, errors.New("bad jobpack offsets: " + jobfile)
+		}
+	}
+	return offsets, file, nil
+}
+
+// read_jobdict reads the job dictionary from the jobpack of the task.
+func read_jobdict(jobfile string) (map[string]interface{}, error) {
+	offsets, file, err := read_offsets(jobfile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if _, err = file.Seek(int64(offsets[1]), 0); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, offsets[2]-offsets[1])
+	if _, err = io.ReadFull(file, buf); err != nil {
+		return nil, err
+	}
+	jobdict := make(map[string]interface{})
+	err = json.Unmarshal(buf, &jobdict)
+	return jobdict, err
+}
+
+// partitions returns the number of partitions of the map outputs, which is
+// the number of reduces of the job.
+func partitions(jobdict map[string]interface{}) int {
+	if reduce, ok := jobdict["reduce?"].(bool); ok && !reduce {
+		return 1
+	}
+	if nr, ok := jobdict["nr_reduces"].(float64); ok && nr > 1 {
+		return int(nr)
+	}
+	return 1
+}
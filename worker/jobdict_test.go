@@ -0,0 +1,31 @@
+package worker
+
+import (
+	"os"
+	"testing"
+
+	"github.com/discoproject/goworker/internal/testutil"
+)
+
+func TestReadJobDict(t *testing.T) {
+	jobfile := testutil.TempJobPack(t, JOBPACK_MAGIC+1, `{"nr_reduces":4,"reduce?":true}`, nil, "")
+	defer os.Remove(jobfile)
+
+	jobdict, err := read_jobdict(jobfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nr := partitions(jobdict); nr != 4 {
+		t.Error("wrong number of partitions", nr)
+	}
+}
+
+func TestPartitions(t *testing.T) {
+	jobdict := map[string]interface{}{"nr_reduces": float64(3), "reduce?": false}
+	if nr := partitions(jobdict); nr != 1 {
+		t.Error("partitioned without reduce", nr)
+	}
+	if nr := partitions(map[string]interface{}{}); nr != 1 {
+		t.Error("wrong default", nr)
+	}
+}
@@ -0,0 +1,122 @@
+package worker
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// jobHome is the job home of the local jobs, the current directory on Disco.
+var jobHome string
+
+// JobHome returns the directory of the job home, where the files added to
+// the jobpack by jobpack are.  Disco starts the tasks in it.
+func JobHome() string {
+	if jobHome != "" {
+		return jobHome
+	}
+	dir, _ := os.Getwd()
+	return dir
+}
+
+// JobFile returns the path of a file of the job home, named like in the
+// jobpack, with slashes.
+func JobFile(name string) string {
+	return filepath.Join(JobHome(), filepath.FromSlash(name))
+}
+
+// JobData returns the jobdata of the jobpack of the running task, which is
+// empty unless it was given to jobpack.
+func JobData() ([]byte, error) {
+	task := CurrentTask()
+	if task == nil {
+		return nil, errors.New("no running task")
+	}
+	if task.Jobfile == "" {
+		return nil, nil
+	}
+	offsets, file, err := read_offsets(task.Jobfile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if _, err = file.Seek(int64(offsets[4]), 0); err != nil {
+		return nil, err
+	}
+	var data bytes.Buffer
+	_, err = io.Copy(&data, file)
+	return data.Bytes(), err
+}
+
+// Params decodes into v the params given to jobpack, which are the JSON
+// encoding of the jobdata.
+func Params(v interface{}) error {
+	data, err := JobData()
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return errors.New("no job params")
+	}
+	if err = json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("bad job params: %s", err)
+	}
+	return nil
+}
+
+// unpackJobHome extracts the files of the job home of a jobpack in dir, like
+// Disco does.
+func unpackJobHome(jobfile string, dir string) error {
+	offsets, file, err := read_offsets(jobfile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	home, err := zip.NewReader(io.NewSectionReader(file, int64(offsets[3]), int64(offsets[4]-offsets[3])),
+		int64(offsets[4]-offsets[3]))
+	if err != nil {
+		return fmt.Errorf("bad job home in %s: %s", jobfile, err)
+	}
+	for _, f := range home.File {
+		name := filepath.Join(dir, filepath.FromSlash(f.Name))
+		if !strings.HasPrefix(name, filepath.Clean(dir)+string(filepath.Separator)) {
+			return fmt.Errorf("bad file name in the job home: %s", f.Name)
+		}
+		if f.FileInfo().IsDir() {
+			if err = os.MkdirAll(name, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		if err = unpackFile(f, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func unpackFile(f *zip.File, name string) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	reader, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode().Perm()|0600)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(file, reader); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,86 @@
+package worker
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/discoproject/goworker/internal/testutil"
+)
+
+func TestJobData(t *testing.T) {
+	jobfile := testutil.TempJobPack(t, JOBPACK_MAGIC+1, `{}`, map[string]string{"job": "binary"}, `{"limit": 3}`)
+	defer os.Remove(jobfile)
+	localWorker(LocalJob{JobFile: jobfile}, "map", 0, Split, Group{ALL_LABELS, ""})
+	defer func() { running = nil }()
+
+	data, err := JobData()
+	if err != nil || string(data) != `{"limit": 3}` {
+		t.Error("wrong jobdata", string(data), err)
+	}
+	var params struct{ Limit int }
+	if err = Params(&params); err != nil || params.Limit != 3 {
+		t.Error("wrong params", params, err)
+	}
+	if err = Params(&[]int{}); err == nil {
+		t.Error("no error for the wrong type of params")
+	}
+
+	running.task.Jobfile = ""
+	if data, err = JobData(); err != nil || len(data) != 0 {
+		t.Error("jobdata without a jobpack", string(data), err)
+	}
+	if err = Params(&params); err == nil {
+		t.Error("no error for missing params")
+	}
+	running = nil
+	if _, err = JobData(); err == nil {
+		t.Error("no error without a task")
+	}
+}
+
+func TestRunLocalJobHome(t *testing.T) {
+	dir, names := testutil.TempInputs(t, "b a c\na")
+	defer os.RemoveAll(dir)
+	jobfile := testutil.TempJobPack(t, JOBPACK_MAGIC+1, `{}`, map[string]string{"job": "binary", "lists/stop.txt": "a\n"}, `{"suffix": "!"}`)
+	defer os.Remove(jobfile)
+
+	// the map skips the stop words of the job home and appends the suffix
+	// of the params
+	stopMap := func(reader io.Reader, writer io.Writer) {
+		stop, err := ioutil.ReadFile(JobFile("lists/stop.txt"))
+		if err != nil {
+			t.Error(err)
+		}
+		var params struct{ Suffix string }
+		if err = Params(&params); err != nil {
+			t.Error(err)
+		}
+		data, _ := ioutil.ReadAll(reader)
+		for _, word := range strings.Fields(string(data)) {
+			if word != strings.TrimSpace(string(stop)) {
+				io.WriteString(writer, word+params.Suffix+"\n")
+			}
+		}
+	}
+	output := filepath.Join(dir, "results")
+	results, err := RunLocal(stopMap, nil, LocalJob{Inputs: names, Output: output, JobFile: jobfile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if all := readResults(t, results); all != "b!\nc!\n" {
+		t.Errorf("wrong results %q", all)
+	}
+	if jobHome != "" {
+		t.Error("job home not reset", jobHome)
+	}
+
+	bad := testutil.TempJobPack(t, JOBPACK_MAGIC+1, `{}`, map[string]string{"../escape": "x"}, "")
+	defer os.Remove(bad)
+	if _, err = RunLocal(stopMap, nil, LocalJob{Inputs: names, Output: output, JobFile: bad}); err == nil {
+		t.Error("no error for a file out of the job home")
+	}
+}
@@ -0,0 +1,277 @@
+package worker
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/discoproject/goworker/jobutil"
+)
+
+// LOCAL_FLAG is the argument which makes Run execute the whole job locally
+// with RunLocal instead of running a task for the master.
+const LOCAL_FLAG = "-local"
+
+// LocalJob is a map/reduce job run without a Disco cluster.
+type LocalJob struct {
+	// Inputs are local files or http(s) URLs.  Every input is processed by
+	// its own map task.
+	Inputs []string
+	// Output is the directory where the results are written.
+	Output string
+	// Partitions is the number of partitions of the map outputs, and the
+	// number of reduce tasks.
+	Partitions int
+	// JobFile is the jobpack of the job, if any.  Its job home is extracted
+	// in a temporary directory, which is the JobHome of the tasks, and its
+	// jobdata is their JobData.
+	JobFile string
+}
+
+// RunLocal runs a map/reduce job on the local machine with the same
+// functions given to Run.  The map outputs are partitioned like on Disco,
+// and the inputs of every reduce are the map outputs of its partition,
+// sorted.  If Reduce is nil, the map outputs are the results.  It returns
+// the names of the result files.
+func RunLocal(Map Process, Reduce Process, job LocalJob) ([]string, error) {
+	if job.Partitions < 1 {
+		job.Partitions = 1
+	}
+	if job.Output == "" {
+		return nil, fmt.Errorf("no output directory")
+	}
+	if err := os.MkdirAll(job.Output, 0755); err != nil {
+		return nil, err
+	}
+	defer func() { running = nil }()
+	if job.JobFile != "" {
+		dir, err := ioutil.TempDir("", "jobhome")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(dir)
+		if err = unpackJobHome(job.JobFile, dir); err != nil {
+			return nil, err
+		}
+		jobHome = dir
+		defer func() { jobHome = "" }()
+	}
+
+	mapDir := job.Output
+	if Reduce != nil {
+		var err error
+		if mapDir, err = ioutil.TempDir(job.Output, "map_"); err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(mapDir)
+	}
+
+	// map, one task per input
+	shuffle := make(map[int][]string)
+	for i, input := range job.Inputs {
+		w := localWorker(job, "map", i, Split, Group{ALL_LABELS, ""})
+		files, err := w.runLocalStage(Map, input, mapDir, "map_out_", job.Partitions, ALL_LABELS)
+		if err != nil {
+			return nil, fmt.Errorf("map of %s failed: %s", input, err)
+		}
+		for label, name := range files {
+			shuffle[label] = append(shuffle[label], name)
+		}
+	}
+	if Reduce == nil {
+		return collect(shuffle), nil
+	}
+
+	// reduce, one task per label
+	labels := make([]int, 0, len(shuffle))
+	for label := range shuffle {
+		labels = append(labels, label)
+	}
+	sort.Ints(labels)
+	results := make(map[int][]string)
+	for _, label := range labels {
+		sorted, err := sortLines(shuffle[label], mapDir)
+		if err != nil {
+			return nil, err
+		}
+		w := localWorker(job, "reduce", label, GroupLabel, Group{label, ""})
+		files, err := w.runLocalStage(Reduce, sorted, job.Output, "reduce_out_", 0, label)
+		if err != nil {
+			return nil, fmt.Errorf("reduce of label %d failed: %s", label, err)
+		}
+		for label, name := range files {
+			results[label] = append(results[label], name)
+		}
+	}
+	return collect(results), nil
+}
+
+func localWorker(job LocalJob, stage string, taskid int, grouping Grouping, group Group) *Worker {
+	w := new(Worker)
+	w.task = &Task{Host: "localhost", Jobname: "local", Taskid: taskid, Stage: stage,
+		Grouping: grouping, Group: group, Jobfile: job.JobFile}
+	running = w
+	return w
+}
+
+// runLocalStage runs process over the input and returns the output file of
+// every label.  partitions is 0 unless the stage is a map, see
+// newStageWriter.
+func (w *Worker) runLocalStage(process Process, input string, dir string,
+	prefix string, partitions int, label int) (map[int]string, error) {
+	reader, err := openLocal(input)
+	if err != nil {
+		return nil, err
+	}
+	output := newStageWriter(dir, prefix, partitions)
+	if label != ALL_LABELS {
+		output.label = label
+	}
+	err = safeProcess(process, reader, output)
+	reader.Close()
+	if cerr := output.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[int]string)
+	for label, file := range output.files {
+		files[label] = file.Name()
+	}
+	return files, nil
+}
+
+// openLocal opens a local file or an URL, and decompresses it.
+func openLocal(input string) (io.ReadCloser, error) {
+	if strings.Contains(input, "://") {
+		return jobutil.OpenAddress(input, "")
+	}
+	file, err := os.Open(input)
+	if err != nil {
+		return nil, err
+	}
+	return jobutil.Decompress(file, input)
+}
+
+// sortLines writes the lines of the files, sorted, in a new file of dir.
+// The files are read one after the other by the sorter, which spills the
+// lines to dir when they take too much memory.
+func sortLines(files []string, dir string) (string, error) {
+	reader := &lineFiles{names: files}
+	defer reader.Close()
+	sorter := &jobutil.Sorter{TempDir: dir}
+	sorted, err := sorter.Sort(reader)
+	if err != nil {
+		return "", err
+	}
+	defer sorted.Close()
+
+	file, err := ioutil.TempFile(dir, "sorted_")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	_, err = io.Copy(file, sorted)
+	return file.Name(), err
+}
+
+// lineFiles reads local files one after the other.  Every file is opened
+// when the previous one is consumed and closed at its end, and a newline is
+// added to its last line if it has none, so that the lines of two files are
+// never joined.
+type lineFiles struct {
+	names   []string
+	current io.ReadCloser
+	last    byte
+	newline bool
+}
+
+func (r *lineFiles) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for {
+		if r.newline {
+			r.newline = false
+			p[0] = '\n'
+			return 1, nil
+		}
+		if r.current == nil {
+			if len(r.names) == 0 {
+				return 0, io.EOF
+			}
+			rc, err := openLocal(r.names[0])
+			if err != nil {
+				return 0, err
+			}
+			r.names = r.names[1:]
+			r.current = rc
+			r.last = '\n'
+		}
+		n, err := r.current.Read(p)
+		if n > 0 {
+			r.last = p[n-1]
+		}
+		if err == io.EOF {
+			err = r.current.Close()
+			r.current = nil
+			r.newline = r.last != '\n'
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+// Close closes the file being read.
+func (r *lineFiles) Close() error {
+	if r.current == nil {
+		return nil
+	}
+	err := r.current.Close()
+	r.current = nil
+	return err
+}
+
+// collect returns the files sorted by label.
+func collect(files map[int][]string) []string {
+	labels := make([]int, 0, len(files))
+	for label := range files {
+		labels = append(labels, label)
+	}
+	sort.Ints(labels)
+	result := make([]string, 0)
+	for _, label := range labels {
+		result = append(result, files[label]...)
+	}
+	return result
+}
+
+// runLocal runs RunLocal with the arguments given after LOCAL_FLAG:
+//
+//	worker -local [-output dir] [-partitions n] [-jobpack file] input...
+func runLocal(Map Process, Reduce Process, args []string) error {
+	var job LocalJob
+	flags := flag.NewFlagSet("local", flag.ContinueOnError)
+	flags.StringVar(&job.Output, "output", "results", "directory of the results")
+	flags.IntVar(&job.Partitions, "partitions", 1, "number of partitions of the map outputs")
+	flags.StringVar(&job.JobFile, "jobpack", "", "jobpack of the job, for its job home and jobdata")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	job.Inputs = flags.Args()
+	results, err := RunLocal(Map, Reduce, job)
+	if err != nil {
+		return err
+	}
+	for _, result := range results {
+		fmt.Println(filepath.Clean(result))
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package worker
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/discoproject/goworker/internal/testutil"
+	"github.com/discoproject/goworker/jobutil"
+)
+
+func localMap(reader io.Reader, writer io.Writer) {
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		for _, word := range strings.Fields(scanner.Text()) {
+			fmt.Fprintln(writer, word)
+		}
+	}
+}
+
+// localReduce counts the runs of equal lines, which are only complete if the
+// input is sorted.
+func localReduce(reader io.Reader, writer io.Writer) {
+	scanner := bufio.NewScanner(reader)
+	last, count := "", 0
+	for scanner.Scan() {
+		if scanner.Text() != last && count > 0 {
+			fmt.Fprintf(writer, "%s %d\n", last, count)
+			count = 0
+		}
+		last = scanner.Text()
+		count++
+	}
+	if count > 0 {
+		fmt.Fprintf(writer, "%s %d\n", last, count)
+	}
+}
+
+func readResults(t *testing.T, results []string) string {
+	var all string
+	for _, result := range results {
+		data, err := ioutil.ReadFile(result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		all += string(data)
+	}
+	return all
+}
+
+func TestRunLocal(t *testing.T) {
+	dir, names := testutil.TempInputs(t, "b a c\na", "c b a\n")
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "results")
+	results, err := RunLocal(localMap, localReduce, LocalJob{Inputs: names, Output: output})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 {
+		t.Fatal("wrong results", results)
+	}
+	if all := readResults(t, results); all != "a 3\nb 2\nc 2\n" {
+		t.Error("wrong results", all)
+	}
+	if files, _ := ioutil.ReadDir(output); len(files) != 1 {
+		t.Error("map outputs not removed", files)
+	}
+	if running != nil {
+		t.Error("running worker not reset")
+	}
+}
+
+func TestRunLocalPartitions(t *testing.T) {
+	dir, names := testutil.TempInputs(t, "a b c d e f\n", "f e d c b a\n")
+	defer os.RemoveAll(dir)
+	job := LocalJob{Inputs: names, Output: filepath.Join(dir, "results"), Partitions: 3}
+	results, err := RunLocal(localMap, localReduce, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, result := range results {
+		data, _ := ioutil.ReadFile(result)
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) != 2 || fields[1] != "2" {
+				t.Error("word not reduced once", line)
+			}
+		}
+	}
+	if lines := strings.Count(readResults(t, results), "\n"); lines != 6 {
+		t.Error("wrong number of words", lines)
+	}
+}
+
+func TestRunLocalMapOnly(t *testing.T) {
+	dir, names := testutil.TempInputs(t, "a b\n", "c\n")
+	defer os.RemoveAll(dir)
+	results, err := RunLocal(localMap, nil, LocalJob{Inputs: names, Output: filepath.Join(dir, "results")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if all := readResults(t, results); all != "a\nb\nc\n" {
+		t.Error("wrong results", all)
+	}
+}
+
+func TestRunLocalMsg(t *testing.T) {
+	dir, names := testutil.TempInputs(t, "a\n")
+	defer os.RemoveAll(dir)
+	var msgErr error
+	process := func(reader io.Reader, writer io.Writer) {
+		msgErr = Msg("stage %s", CurrentTask().Stage)
+		io.Copy(writer, reader)
+	}
+	if _, err := RunLocal(process, nil, LocalJob{Inputs: names, Output: filepath.Join(dir, "results")}); err != nil {
+		t.Fatal(err)
+	}
+	if msgErr != nil {
+		t.Error("Msg failed in a local job", msgErr)
+	}
+}
+
+func TestRunLocalError(t *testing.T) {
+	dir, names := testutil.TempInputs(t, "a\n")
+	defer os.RemoveAll(dir)
+	crash := func(io.Reader, io.Writer) {
+		panic("crash")
+	}
+	_, err := RunLocal(localMap, crash, LocalJob{Inputs: names, Output: filepath.Join(dir, "results")})
+	if err == nil || !strings.Contains(err.Error(), "crash") {
+		t.Error("wrong error", err)
+	}
+	_, err = RunLocal(localMap, nil, LocalJob{Inputs: []string{filepath.Join(dir, "missing")}, Output: dir})
+	if err == nil {
+		t.Error("no error for a missing input")
+	}
+}
+
+func TestRunLocalCompressed(t *testing.T) {
+	dir, names := testutil.TempInputs(t, "b a\n", "a\n")
+	defer os.RemoveAll(dir)
+	Map := Compress(localMap, jobutil.Gzip)
+	job := LocalJob{Inputs: names, Output: filepath.Join(dir, "results"), Partitions: 2}
+	results, err := RunLocal(Map, localReduce, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := readResults(t, results)
+	if !strings.Contains(counts, "a 2\n") || !strings.Contains(counts, "b 1\n") {
+		t.Error("wrong results", counts)
+	}
+}
+
+func TestSortLines(t *testing.T) {
+	dir, names := testutil.TempInputs(t, "b 1\na 1", "", "c 1\n", "a 2")
+	defer os.RemoveAll(dir)
+	// the newlines are added even with the smallest reads
+	data, err := ioutil.ReadAll(iotest.OneByteReader(&lineFiles{names: names}))
+	if err != nil || string(data) != "b 1\na 1\nc 1\na 2\n" {
+		t.Errorf("wrong lines %q %v", data, err)
+	}
+
+	sorted, err := sortLines(names, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(sorted); string(data) != "a 1\na 2\nb 1\nc 1\n" {
+		t.Errorf("wrong sorted lines %q", data)
+	}
+	if _, err = sortLines([]string{names[0], filepath.Join(dir, "missing")}, dir); err == nil {
+		t.Error("no error for a missing file")
+	}
+}
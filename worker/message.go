@@ -0,0 +1,136 @@
+package worker
+
+import (
+	"fmt"
+	"io"
+	"os"
+	rdebug "runtime/debug"
+)
+
+// exit terminates the worker after an ERROR or FATAL message.
+var exit = os.Exit
+
+// retryError is an error after which the task can be retried, like an input
+// which cannot be read or a panic in a Process function.
+type retryError struct {
+	err error
+}
+
+func (e *retryError) Error() string {
+	return e.err.Error()
+}
+
+// fatalError is an error after which the job has to be stopped.  Like the
+// other errors it is reported with FATAL, but it is also let through by
+// safeProcess.
+type fatalError struct {
+	err error
+}
+
+func (e *fatalError) Error() string {
+	return e.err.Error()
+}
+
+func runningConn() (*Conn, error) {
+	if running == nil {
+		return nil, fmt.Errorf("no task is running")
+	}
+	return running.conn, nil
+}
+
+// Msg sends a status message to the master.  The messages are shown in the
+// Disco web UI for the job.  When the job is run locally, they are printed
+// on the standard error.
+func Msg(format string, a ...interface{}) error {
+	conn, err := runningConn()
+	if err != nil {
+		return err
+	}
+	if conn == nil {
+		_, err = fmt.Fprintf(os.Stderr, format+"\n", a...)
+		return err
+	}
+	return conn.request("MSG", fmt.Sprintf(format, a...))
+}
+
+// Ping tells the master that the worker is still alive.
+func Ping() error {
+	conn, err := runningConn()
+	if err != nil || conn == nil {
+		return err
+	}
+	return conn.request("PING", "")
+}
+
+// processing is the number of Process functions being run by safeProcess,
+// more than one when a combiner runs under a Process.
+var processing int
+
+// Error stops the Process function which calls it, and the task fails with a
+// transient error: the master will retry it, possibly on another node.
+// Called out of a Process function, it reports the error to the master and
+// terminates the worker.  Error only stops the Process function when it is
+// called from its goroutine, the goroutines started by a Process function
+// have to hand their errors over to it instead.
+func Error(format string, a ...interface{}) {
+	stop(&retryError{fmt.Errorf(format, a...)})
+}
+
+// Fatal stops the Process function which calls it, and the task fails with
+// a permanent error: the whole job fails.  Like Error, it terminates the
+// worker when called out of a Process function.
+func Fatal(format string, a ...interface{}) {
+	stop(&fatalError{fmt.Errorf(format, a...)})
+}
+
+// stop raises err in the running Process function, for safeProcess to return
+// it.  Out of a Process function, it reports err and terminates the worker.
+func stop(err error) {
+	if processing > 0 {
+		panic(err)
+	}
+	if running != nil && running.conn != nil {
+		running.report(err)
+	} else {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	exit(1)
+}
+
+// report reports err to the master, with ERROR if the task can be retried
+// and FATAL otherwise, and returns it.
+func (w *Worker) report(err error) error {
+	if err == nil {
+		return nil
+	}
+	fmt.Fprintln(os.Stderr, err)
+	debug("error", err)
+	name := "FATAL"
+	if _, ok := err.(*retryError); ok {
+		name = "ERROR"
+	}
+	w.conn.request(name, err.Error())
+	return err
+}
+
+// safeProcess runs process and turns a panic raised in it into an error
+// carrying the stack trace of the panic.  The errors raised with Error and
+// Fatal are returned as they are.
+func safeProcess(process Process, reader io.Reader, writer io.Writer) (err error) {
+	processing++
+	defer func() {
+		processing--
+		if r := recover(); r != nil {
+			switch e := r.(type) {
+			case *retryError:
+				err = e
+			case *fatalError:
+				err = e
+			default:
+				err = &retryError{fmt.Errorf("%v\n%s", r, rdebug.Stack())}
+			}
+		}
+	}()
+	process(reader, writer)
+	return nil
+}
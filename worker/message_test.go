@@ -0,0 +1,88 @@
+package worker
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSafeProcess(t *testing.T) {
+	process := func(reader io.Reader, writer io.Writer) {
+		io.Copy(writer, reader)
+	}
+	err := safeProcess(process, strings.NewReader("a"), ioutil.Discard)
+	if err != nil {
+		t.Error("unexpected error", err)
+	}
+}
+
+func TestSafeProcessPanic(t *testing.T) {
+	process := func(reader io.Reader, writer io.Writer) {
+		panic("bad record")
+	}
+	err := safeProcess(process, strings.NewReader("a"), ioutil.Discard)
+	if err == nil {
+		t.Fatal("panic not reported")
+	}
+	if !strings.HasPrefix(err.Error(), "bad record\n") {
+		t.Error("wrong message", err)
+	}
+	if !strings.Contains(err.Error(), "TestSafeProcessPanic") {
+		t.Error("no stack trace", err)
+	}
+}
+
+func TestSafeProcessError(t *testing.T) {
+	process := func(reader io.Reader, writer io.Writer) {
+		Fatal("bad input %d", 3)
+	}
+	err := safeProcess(process, strings.NewReader("a"), ioutil.Discard)
+	if _, ok := err.(*fatalError); !ok || err.Error() != "bad input 3" {
+		t.Error("wrong error", err)
+	}
+}
+
+func TestSafeProcessCheck(t *testing.T) {
+	process := func(reader io.Reader, writer io.Writer) {
+		Check(nil)
+		Check(errors.New("disk full"))
+		t.Error("process not stopped")
+	}
+	err := safeProcess(process, strings.NewReader("a"), ioutil.Discard)
+	if _, ok := err.(*retryError); !ok || err.Error() != "disk full" {
+		t.Error("wrong error", err)
+	}
+}
+
+func TestReport(t *testing.T) {
+	var out bytes.Buffer
+	w := &Worker{conn: NewConn(strings.NewReader("OK 4 \"ok\"\n"), &out)}
+	err := &retryError{errors.New("input gone")}
+	if w.report(err) != err {
+		t.Error("error not returned")
+	}
+	if out.String() != "ERROR 12 \"input gone\"\n" {
+		t.Error("wrong message", out.String())
+	}
+}
+
+func TestErrorOutOfProcess(t *testing.T) {
+	var out bytes.Buffer
+	running = &Worker{conn: NewConn(strings.NewReader("OK 4 \"ok\"\n"), &out)}
+	defer func() { running = nil }()
+	code := 0
+	exit = func(c int) { code = c }
+	defer func() { exit = os.Exit }()
+
+	Fatal("no config %s", "x")
+	if code != 1 {
+		t.Error("worker not terminated", code)
+	}
+	if out.String() != "FATAL 13 \"no config x\"\n" {
+		t.Error("wrong message", out.String())
+	}
+}
@@ -0,0 +1,77 @@
+package worker
+
+import (
+	"errors"
+	"fmt"
+)
+
+// JobOptions are the options of a job which go in its jobdict.  A worker
+// declares them with SetJobOptions, and jobpack overrides them with its
+// flags or with a job config file, which is a JSON object with the same
+// keys.  The zero values stand for the defaults of jobpack.
+type JobOptions struct {
+	// Prefix is the name of the job, the start of the name given to it by
+	// the master.  It defaults to gojob.
+	Prefix string `json:"prefix,omitempty"`
+	// Partitions is the number of partitions of the map outputs, and
+	// NrReduces the number of reduce tasks.  They are the same thing for
+	// the Go workers, so setting one sets the other.  They default to 1.
+	Partitions int `json:"partitions,omitempty"`
+	NrReduces  int `json:"nr_reduces,omitempty"`
+	// SaveResults saves the results of the job in DDFS.
+	SaveResults bool `json:"save_results,omitempty"`
+	// SaveInfo is where the information of the job is saved, ddfs by
+	// default.
+	SaveInfo  string    `json:"save_info,omitempty"`
+	Scheduler Scheduler `json:"scheduler"`
+}
+
+// Scheduler are the options of the scheduling of the tasks of a job.
+type Scheduler struct {
+	// MaxCores is the most tasks of the job run at once, unlimited if 0.
+	MaxCores int `json:"max_cores,omitempty"`
+	// ForceLocal runs the tasks on the nodes of their inputs, and
+	// ForceRemote on other nodes.
+	ForceLocal  bool `json:"force_local,omitempty"`
+	ForceRemote bool `json:"force_remote,omitempty"`
+}
+
+// Validate checks the options and sets the defaults of the missing ones.
+func (o *JobOptions) Validate() error {
+	if o.Partitions < 0 || o.NrReduces < 0 {
+		return errors.New("negative number of partitions")
+	}
+	if o.Partitions > 0 && o.NrReduces > 0 && o.Partitions != o.NrReduces {
+		return fmt.Errorf("different partitions and nr_reduces: %d and %d", o.Partitions, o.NrReduces)
+	}
+	if o.Scheduler.MaxCores < 0 {
+		return errors.New("negative max_cores")
+	}
+	if o.Scheduler.ForceLocal && o.Scheduler.ForceRemote {
+		return errors.New("force_local and force_remote are both set")
+	}
+	if o.Prefix == "" {
+		o.Prefix = "gojob"
+	}
+	if o.Partitions == 0 {
+		o.Partitions = o.NrReduces
+	}
+	if o.Partitions == 0 {
+		o.Partitions = 1
+	}
+	o.NrReduces = o.Partitions
+	if o.SaveInfo == "" {
+		o.SaveInfo = "ddfs"
+	}
+	return nil
+}
+
+// jobOptions are the options declared by the worker.
+var jobOptions *JobOptions
+
+// SetJobOptions declares the options of the job of the worker, before Run
+// or RunPipeline.  jobpack gets them with the -describe flag, they are not
+// used by the tasks.
+func SetJobOptions(options JobOptions) {
+	jobOptions = &options
+}
@@ -0,0 +1,70 @@
+package worker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestJobOptionsValidate(t *testing.T) {
+	options := JobOptions{NrReduces: 4}
+	if err := options.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	expected := JobOptions{Prefix: "gojob", Partitions: 4, NrReduces: 4, SaveInfo: "ddfs"}
+	if options != expected {
+		t.Error("wrong defaults", options)
+	}
+	for _, bad := range []JobOptions{
+		{Partitions: -1},
+		{Partitions: 2, NrReduces: 3},
+		{Scheduler: Scheduler{MaxCores: -1}},
+		{Scheduler: Scheduler{ForceLocal: true, ForceRemote: true}},
+	} {
+		if err := bad.Validate(); err == nil {
+			t.Error("no error for", bad)
+		}
+	}
+}
+
+func TestDescribeOptions(t *testing.T) {
+	defer func() { jobOptions = nil }()
+	SetJobOptions(JobOptions{Prefix: "count", Scheduler: Scheduler{MaxCores: 10}})
+
+	stdout := os.Stdout
+	defer func() { os.Stdout = stdout }()
+	file, err := ioutil.TempFile("", "describe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	os.Stdout = file
+	err = describe(nil)
+	os.Stdout = stdout
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := ioutil.ReadFile(file.Name())
+	var description map[string]map[string]interface{}
+	if err = json.Unmarshal(data, &description); err != nil {
+		t.Fatal(err, string(data))
+	}
+	if _, ok := description["pipeline"]; ok {
+		t.Error("pipeline of a map/reduce worker", string(data))
+	}
+	options := description["options"]
+	if options["prefix"] != "count" || options["scheduler"].(map[string]interface{})["max_cores"] != 10.0 {
+		t.Error("wrong options", string(data))
+	}
+	if _, ok := options["nr_reduces"]; ok {
+		t.Error("default option described", string(data))
+	}
+
+	SetJobOptions(JobOptions{Partitions: -1})
+	if err = describe(nil); err == nil {
+		t.Error("no error for invalid options")
+	}
+}
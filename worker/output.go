@@ -0,0 +1,392 @@
+package worker
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/discoproject/goworker/jobutil"
+)
+
+// Partitioner returns the label of the partition a record with the given key
+// belongs to, a number between 0 and partitions-1.
+type Partitioner func(key []byte, partitions int) int
+
+// HashPartitioner is the default partitioner.  It distributes the keys by
+// their FNV-1a hash so that every node assigns a key to the same partition.
+func HashPartitioner(key []byte, partitions int) int {
+	h := fnv.New32a()
+	h.Write(key)
+	return int(h.Sum32() % uint32(partitions))
+}
+
+// Writer is the io.Writer handed to the Process functions.  It writes one
+// output file per label, and every file is reported to the master as an
+// output of the task with its label.
+//
+// When the stage has more than one partition, the data written with Write is
+// split into newline terminated records which are assigned to a partition
+// with the Partitioner, using the first field of the record as the key.
+// Otherwise everything written with Write goes to the default label, which is
+// the label of the group for the group_label and group_label_node stages and
+// 0 for the others.  WriteRecord and Label let a Process choose the partition
+// itself:
+//
+//	func Map(reader io.Reader, writer io.Writer) {
+//		out := writer.(*worker.Writer)
+//		out.Label(1).Write([]byte("goes to the second reduce\n"))
+//	}
+//
+// A Writer can also combine the records of every label with SetCombiner
+// before they are written, and compress its files with SetCompression.
+type Writer struct {
+	dir         string
+	prefix      string
+	partitions  int
+	partitioner Partitioner
+	label       int
+	// labels is the number of labels the outputs can have, 0 to labels-1,
+	// or 0 when they can have any label.
+	labels  int
+	files   map[int]*os.File
+	partial []byte
+	// compressors of the files, when they are compressed
+	compression jobutil.Compression
+	compressors map[int]io.WriteCloser
+	// combiner state
+	combiner Process
+	memory   int
+	buffered int
+	buffers  map[int]*bytes.Buffer
+	err      error
+}
+
+// DEFAULT_COMBINE_MEMORY is the memory used to buffer the records to
+// combine when SetCombiner is not given a size.
+const DEFAULT_COMBINE_MEMORY = 16 * 1024 * 1024
+
+func newWriter(dir string, prefix string, partitions int) *Writer {
+	w := new(Writer)
+	w.dir = dir
+	w.prefix = prefix
+	w.partitions = partitions
+	w.partitioner = HashPartitioner
+	w.files = make(map[int]*os.File)
+	w.compressors = make(map[int]io.WriteCloser)
+	return w
+}
+
+// newStageWriter returns the writer of a stage.  partitions is the number of
+// partitions of a map stage, which are the only labels of its outputs, or 0
+// for the other stages, whose outputs can have any label.
+func newStageWriter(dir string, prefix string, partitions int) *Writer {
+	if partitions == 0 {
+		return newWriter(dir, prefix, 1)
+	}
+	w := newWriter(dir, prefix, partitions)
+	w.labels = partitions
+	return w
+}
+
+// Partitions returns the number of partitions of the output.
+func (w *Writer) Partitions() int {
+	return w.partitions
+}
+
+// SetPartitioner replaces the partitioner used for the records written with
+// Write and WriteRecord.
+func (w *Writer) SetPartitioner(partitioner Partitioner) {
+	w.partitioner = partitioner
+}
+
+// SetCompression makes the writer compress its files with compression.  The
+// names of the files get the extension of the compression, and the readers of
+// jobutil decompress them transparently.  SetCompression must be called
+// before anything is written.
+func (w *Writer) SetCompression(compression jobutil.Compression) error {
+	if _, err := jobutil.Compress(ioutil.Discard, compression); err != nil {
+		return err
+	}
+	w.compression = compression
+	return nil
+}
+
+// Compress returns a Process which runs process with the compression set on
+// its Writer:
+//
+//	worker.Run(worker.Compress(Map, jobutil.Gzip), Reduce)
+func Compress(process Process, compression jobutil.Compression) Process {
+	return func(reader io.Reader, writer io.Writer) {
+		if w, ok := writer.(*Writer); ok {
+			if err := w.SetCompression(compression); err != nil {
+				Fatal("%s", err)
+			}
+		}
+		process(reader, writer)
+	}
+}
+
+// SetCombiner makes the writer combine the records of every label before
+// they are written.  The records are buffered until they take more than
+// memory bytes, DEFAULT_COMBINE_MEMORY if memory is 0, then the records of
+// every label are sorted like with jobutil.Sorted and written through
+// combiner, which usually merges the records with the same key.  The records
+// are combined again when the buffers are full, so a key can still have
+// several records in the output of a task.  SetCombiner must be called
+// before anything is written.
+func (w *Writer) SetCombiner(combiner Process, memory int) {
+	if memory <= 0 {
+		memory = DEFAULT_COMBINE_MEMORY
+	}
+	w.combiner = combiner
+	w.memory = memory
+	w.buffers = make(map[int]*bytes.Buffer)
+}
+
+// Combine returns a Process which runs Map with combiner set on its Writer,
+// for instance to pass to Run:
+//
+//	worker.Run(worker.Combine(Map, Combiner), Reduce)
+//
+// Reduce functions which only aggregate their input can usually be used as
+// combiners, like a ReduceRecords which counts words.
+func Combine(Map Process, combiner Process) Process {
+	return func(reader io.Reader, writer io.Writer) {
+		if w, ok := writer.(*Writer); ok {
+			w.SetCombiner(combiner, 0)
+		}
+		Map(reader, writer)
+	}
+}
+
+// combine buffers data until the buffers are full.
+func (w *Writer) combine(label int, data []byte) (int, error) {
+	buffer, ok := w.buffers[label]
+	if !ok {
+		buffer = new(bytes.Buffer)
+		w.buffers[label] = buffer
+	}
+	buffer.Write(data)
+	w.buffered += len(data)
+	if w.buffered >= w.memory {
+		if err := w.spill(false); err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+// spill combines the buffered records and writes them to the output files.
+// Unless all is true, the last record of a label is kept in its buffer if it
+// is not terminated yet.
+func (w *Writer) spill(all bool) error {
+	w.buffered = 0
+	for label, buffer := range w.buffers {
+		data := buffer.Bytes()
+		if !all {
+			data = data[:bytes.LastIndex(data, []byte("\n"))+1]
+		}
+		if len(data) != 0 {
+			if err := w.combineLabel(label, data); err != nil {
+				w.err = err
+				return err
+			}
+		}
+		buffer.Next(len(data))
+		w.buffered += buffer.Len()
+	}
+	return nil
+}
+
+func (w *Writer) combineLabel(label int, data []byte) error {
+	file, err := w.writer(label)
+	if err != nil {
+		return err
+	}
+	sorter := &jobutil.Sorter{Memory: len(data) + 1, Key: jobutil.FirstField}
+	sorted, err := sorter.Sort(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer sorted.Close()
+	return safeProcess(w.combiner, sorted, file)
+}
+
+// Flush combines and writes the records buffered for the combiner.
+func (w *Writer) Flush() error {
+	if w.err != nil || w.combiner == nil {
+		return w.err
+	}
+	return w.spill(true)
+}
+
+// file creates the output file of a label, and its compressor.
+func (w *Writer) file(label int) (*os.File, error) {
+	if file, ok := w.files[label]; ok {
+		return file, nil
+	}
+	pattern := fmt.Sprintf("%s%d_*%s", w.prefix, label, w.compression.Extension())
+	file, err := ioutil.TempFile(w.dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	w.files[label] = file
+	if w.compression != jobutil.NoCompression {
+		if w.compressors[label], err = jobutil.Compress(file, w.compression); err != nil {
+			return nil, err
+		}
+	}
+	return file, nil
+}
+
+// writer returns the writer of the output file of a label.
+func (w *Writer) writer(label int) (io.Writer, error) {
+	file, err := w.file(label)
+	if err != nil {
+		return nil, err
+	}
+	if compressor, ok := w.compressors[label]; ok {
+		return compressor, nil
+	}
+	return file, nil
+}
+
+// WriteLabel writes data to the output file of the given label.  The labels
+// of the outputs of a map stage are the partitions, the labels of the other
+// stages can be any positive number.  A wrong label fails the task even if
+// the error is ignored.
+func (w *Writer) WriteLabel(label int, data []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if label < 0 || w.labels > 0 && label >= w.labels {
+		w.err = fmt.Errorf("label %d out of the %d partitions", label, w.labels)
+		if label < 0 {
+			w.err = fmt.Errorf("negative label %d", label)
+		}
+		return 0, w.err
+	}
+	if w.combiner != nil {
+		return w.combine(label, data)
+	}
+	writer, err := w.writer(label)
+	if err != nil {
+		return 0, err
+	}
+	return writer.Write(data)
+}
+
+// WriteRecord writes a record to the partition of its key.
+func (w *Writer) WriteRecord(key []byte, record []byte) error {
+	label := w.label
+	if w.partitions > 1 {
+		label = w.partitioner(key, w.partitions)
+	}
+	_, err := w.WriteLabel(label, record)
+	return err
+}
+
+type labelWriter struct {
+	w     *Writer
+	label int
+}
+
+func (lw *labelWriter) Write(p []byte) (int, error) {
+	return lw.w.WriteLabel(lw.label, p)
+}
+
+// Label returns a writer for the output file of the given label.
+func (w *Writer) Label(label int) io.Writer {
+	return &labelWriter{w, label}
+}
+
+// recordKey returns the first field of a line.
+func recordKey(line []byte) []byte {
+	if index := bytes.IndexAny(line, " \t\n"); index != -1 {
+		return line[:index]
+	}
+	return line
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.partitions <= 1 {
+		return w.WriteLabel(w.label, p)
+	}
+	data := p
+	if len(w.partial) != 0 {
+		data = append(w.partial, p...)
+		w.partial = nil
+	}
+	for len(data) != 0 {
+		index := bytes.IndexByte(data, '\n')
+		if index == -1 {
+			w.partial = append([]byte(nil), data...)
+			break
+		}
+		line := data[:index+1]
+		if err := w.WriteRecord(recordKey(line), line); err != nil {
+			return 0, err
+		}
+		data = data[index+1:]
+	}
+	return len(p), nil
+}
+
+// Close writes the last record if it was not terminated with a newline,
+// flushes the records buffered for the combiner and closes the output files
+// and their compressors.
+func (w *Writer) Close() error {
+	var err error
+	if len(w.partial) != 0 {
+		err = w.WriteRecord(recordKey(w.partial), w.partial)
+		w.partial = nil
+	}
+	if ferr := w.Flush(); err == nil {
+		err = ferr
+	}
+	for _, compressor := range w.compressors {
+		if cerr := compressor.Close(); err == nil {
+			err = cerr
+		}
+	}
+	for _, file := range w.files {
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// outputs returns the outputs of the task sorted by label.  The locations are
+// relative to the disco data directory.
+func (w *Writer) outputs(discoData string) ([]*Output, error) {
+	absDiscoPath, err := filepath.EvalSymlinks(discoData)
+	if err != nil {
+		return nil, err
+	}
+	labels := make([]int, 0, len(w.files))
+	for label := range w.files {
+		labels = append(labels, label)
+	}
+	sort.Ints(labels)
+
+	outputs := make([]*Output, len(labels))
+	for i, label := range labels {
+		file := w.files[label]
+		fileinfo, err := os.Stat(file.Name())
+		if err != nil {
+			return nil, err
+		}
+		outputs[i] = new(Output)
+		outputs[i].label = label
+		outputs[i].output_location =
+			"disco://" + jobutil.Setting("HOST") + "/disco/" + file.Name()[len(absDiscoPath)+1:]
+		outputs[i].output_size = fileinfo.Size()
+	}
+	return outputs, nil
+}
@@ -0,0 +1,234 @@
+package worker
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/discoproject/goworker/jobutil"
+)
+
+func readOutputs(t *testing.T, w *Writer) map[int]string {
+	result := make(map[int]string)
+	for label, file := range w.files {
+		data, err := ioutil.ReadFile(file.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		result[label] = string(data)
+	}
+	return result
+}
+
+func TestHashPartitioner(t *testing.T) {
+	for _, key := range []string{"", "a", "hello", "world"} {
+		label := HashPartitioner([]byte(key), 3)
+		if label < 0 || label >= 3 {
+			t.Error("label out of range", key, label)
+		}
+		if label != HashPartitioner([]byte(key), 3) {
+			t.Error("partitioner is not stable", key)
+		}
+	}
+}
+
+func TestWriterSinglePartition(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "writer")
+	defer os.RemoveAll(dir)
+	w := newWriter(dir, "out_", 1)
+	w.Write([]byte("a 1\nb"))
+	w.Write([]byte(" 2\n"))
+	w.Close()
+	outputs := readOutputs(t, w)
+	if len(outputs) != 1 || outputs[0] != "a 1\nb 2\n" {
+		t.Error("wrong outputs", outputs)
+	}
+}
+
+func TestWriterPartitions(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "writer")
+	defer os.RemoveAll(dir)
+	w := newWriter(dir, "out_", 2)
+	w.SetPartitioner(func(key []byte, partitions int) int {
+		if strings.HasPrefix(string(key), "a") {
+			return 0
+		}
+		return 1
+	})
+	w.Write([]byte("a 1\nb 2\naa"))
+	w.Write([]byte(" 3\nbb"))
+	w.Close()
+	outputs := readOutputs(t, w)
+	if outputs[0] != "a 1\naa 3\n" {
+		t.Error("wrong partition 0", outputs[0])
+	}
+	if outputs[1] != "b 2\nbb" {
+		t.Error("wrong partition 1", outputs[1])
+	}
+}
+
+func TestWriterLabel(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "writer")
+	defer os.RemoveAll(dir)
+	w := newWriter(dir, "out_", 4)
+	w.Label(3).Write([]byte("x"))
+	w.Label(1).Write([]byte("y"))
+	w.Close()
+
+	jobutil.SetKeyValue("HOST", "localhost")
+	outputs, err := w.outputs(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outputs) != 2 || outputs[0].label != 1 || outputs[1].label != 3 {
+		t.Fatal("wrong outputs", outputs)
+	}
+	if !strings.HasPrefix(outputs[1].output_location, "disco://localhost/disco/out_3_") {
+		t.Error("wrong location", outputs[1].output_location)
+	}
+	if outputs[1].output_size != 1 {
+		t.Error("wrong size", outputs[1].output_size)
+	}
+}
+
+func TestWriterLabelRange(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "writer")
+	defer os.RemoveAll(dir)
+	w := newStageWriter(dir, "out_", 2)
+	if _, err := w.Label(2).Write([]byte("x")); err == nil {
+		t.Error("no error for a label out of the partitions")
+	}
+	if err := w.Close(); err == nil {
+		t.Error("wrong label ignored")
+	}
+
+	w = newStageWriter(dir, "out_", 2)
+	w.SetPartitioner(func(key []byte, partitions int) int { return partitions })
+	if _, err := w.Write([]byte("a 1\n")); err == nil {
+		t.Error("no error for a wrong partitioner")
+	}
+
+	w = newStageWriter(dir, "out_", 0)
+	if _, err := w.Label(7).Write([]byte("x")); err != nil {
+		t.Error("label refused in a stage without partitions", err)
+	}
+	if _, err := w.Label(-2).Write([]byte("x")); err == nil {
+		t.Error("no error for a negative label")
+	}
+	w.Close()
+}
+
+func TestWriterDefaultLabel(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "writer")
+	defer os.RemoveAll(dir)
+	w := newWriter(dir, "out_", 1)
+	w.label = 5
+	w.Write([]byte("a 1\n"))
+	w.Close()
+	outputs := readOutputs(t, w)
+	if len(outputs) != 1 || outputs[5] != "a 1\n" {
+		t.Error("wrong outputs", outputs)
+	}
+}
+
+// countCombiner merges the sorted "word count" lines of the same word.
+func countCombiner(reader io.Reader, writer io.Writer) {
+	g := jobutil.NewKeyGrouper(reader, jobutil.FieldKey)
+	for g.Scan() {
+		total := 0
+		for g.Next() {
+			n, _ := strconv.Atoi(string(g.Value()))
+			total += n
+		}
+		fmt.Fprintf(writer, "%s %d\n", g.Key(), total)
+	}
+}
+
+func TestWriterCombiner(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "writer")
+	defer os.RemoveAll(dir)
+	w := newWriter(dir, "out_", 1)
+	w.SetCombiner(countCombiner, 0)
+	w.Write([]byte("b 1\na 1\nb"))
+	w.Write([]byte(" 2\n"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	outputs := readOutputs(t, w)
+	if len(outputs) != 1 || outputs[0] != "a 1\nb 3\n" {
+		t.Error("wrong outputs", outputs)
+	}
+}
+
+func TestWriterCombinerSpill(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "writer")
+	defer os.RemoveAll(dir)
+	w := newWriter(dir, "out_", 2)
+	w.SetPartitioner(func(key []byte, partitions int) int {
+		if string(key) == "a" {
+			return 0
+		}
+		return 1
+	})
+	w.SetCombiner(countCombiner, 12)
+	for i := 0; i < 4; i++ {
+		w.Write([]byte("a 1\nb 1\n"))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	outputs := readOutputs(t, w)
+	// every spill combines the 3 buffered lines
+	if outputs[0] != "a 2\na 1\na 1\n" || outputs[1] != "b 1\nb 2\nb 1\n" {
+		t.Error("wrong outputs", outputs)
+	}
+}
+
+func TestWriterCombinerError(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "writer")
+	defer os.RemoveAll(dir)
+	w := newWriter(dir, "out_", 1)
+	w.SetCombiner(func(io.Reader, io.Writer) { Fatal("bad combiner") }, 4)
+	if _, err := w.Write([]byte("a 1\n")); err == nil {
+		t.Error("no error from the combiner")
+	}
+	if _, err := w.Write([]byte("a 1\n")); err == nil {
+		t.Error("error not kept")
+	}
+	if _, ok := w.Close().(*fatalError); !ok {
+		t.Error("fatal error not returned by Close")
+	}
+}
+
+func TestWriterCompression(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "writer")
+	defer os.RemoveAll(dir)
+	w := newWriter(dir, "out_", 1)
+	if err := w.SetCompression(jobutil.Bzip2); err == nil {
+		t.Error("no error for bzip2")
+	}
+	if err := w.SetCompression(jobutil.Gzip); err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("a 1\n"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	name := w.files[0].Name()
+	if !strings.HasSuffix(name, ".gz") {
+		t.Error("no extension", name)
+	}
+	file, _ := os.Open(name)
+	rc, err := jobutil.Decompress(file, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if data, _ := ioutil.ReadAll(rc); string(data) != "a 1\n" {
+		t.Error("wrong data", string(data))
+	}
+}
@@ -0,0 +1,205 @@
+package worker
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Grouping is the way the master groups the outputs of a stage into the
+// tasks of the next stage.
+type Grouping string
+
+const (
+	// Split runs one task per input.
+	Split Grouping = "split"
+	// GroupLabel runs one task per label with all the inputs of that label.
+	GroupLabel Grouping = "group_label"
+	// GroupNode runs one task per node with all the inputs on that node.
+	GroupNode Grouping = "group_node"
+	// GroupLabelNode runs one task per label and node.
+	GroupLabelNode Grouping = "group_label_node"
+	// GroupAll runs a single task with all the inputs.
+	GroupAll Grouping = "group_all"
+)
+
+// ALL_LABELS is the "all" label of the groups and inputs which are not
+// restricted to a single label.
+const ALL_LABELS = -1
+
+// Group is the group of inputs of a task, made of a label and a host.  The
+// label is ALL_LABELS unless the grouping is by label, and the host is empty
+// unless the grouping is by node.
+type Group struct {
+	Label int
+	Host  string
+}
+
+// UnmarshalJSON decodes the [label, host] pair sent by the master, where the
+// label is either a number or "all".
+func (g *Group) UnmarshalJSON(data []byte) error {
+	var pair []json.RawMessage
+	if err := json.Unmarshal(data, &pair); err != nil {
+		return err
+	}
+	if len(pair) != 2 {
+		return fmt.Errorf("bad group: %s", data)
+	}
+	var err error
+	if g.Label, err = decode_label(pair[0]); err != nil {
+		return err
+	}
+	if string(pair[1]) == "null" {
+		g.Host = ""
+		return nil
+	}
+	return json.Unmarshal(pair[1], &g.Host)
+}
+
+// label returns the label of the inputs and the default label of the outputs
+// of the task, or ALL_LABELS if the task is not restricted to one label.
+func (t *Task) label() int {
+	if t.Grouping == GroupLabel || t.Grouping == GroupLabelNode {
+		return t.Group.Label
+	}
+	return ALL_LABELS
+}
+
+func (g Grouping) valid() bool {
+	switch g {
+	case Split, GroupLabel, GroupNode, GroupLabelNode, GroupAll:
+		return true
+	}
+	return false
+}
+
+// Stage is a named stage of a pipeline job.
+type Stage struct {
+	Name     string
+	Grouping Grouping
+	// Concurrent lets the tasks of the stage start before the previous stage
+	// is done.  They then receive their inputs as they become available.
+	Concurrent bool
+	Process    Process
+}
+
+// DESCRIBE_FLAG is the argument which makes a worker print the description
+// of its pipeline and its job options instead of running a task.  jobpack
+// uses it to write the pipeline and the options of the job in the jobdict.
+const DESCRIBE_FLAG = "-describe"
+
+// pipeline returns the list of stages in the format of the jobdict.
+func pipeline(stages []Stage) [][]interface{} {
+	result := make([][]interface{}, len(stages))
+	for i, stage := range stages {
+		result[i] = []interface{}{stage.Name, stage.Grouping, stage.Concurrent}
+	}
+	return result
+}
+
+func validatePipeline(stages []Stage) error {
+	if len(stages) == 0 {
+		return fmt.Errorf("empty pipeline")
+	}
+	names := make(map[string]bool)
+	for _, stage := range stages {
+		if stage.Name == "" {
+			return fmt.Errorf("stage without a name")
+		}
+		if names[stage.Name] {
+			return fmt.Errorf("duplicate stage: %s", stage.Name)
+		}
+		names[stage.Name] = true
+		if !stage.Grouping.valid() {
+			return fmt.Errorf("invalid grouping for stage %s: %s", stage.Name, stage.Grouping)
+		}
+		if stage.Process == nil {
+			return fmt.Errorf("stage without a process: %s", stage.Name)
+		}
+	}
+	return nil
+}
+
+// describe prints the pipeline, if any, and the options declared by the
+// worker.
+func describe(stages []Stage) error {
+	type Description struct {
+		Pipeline [][]interface{} `json:"pipeline,omitempty"`
+		Options  *JobOptions     `json:"options,omitempty"`
+	}
+	description := Description{Options: jobOptions}
+	if stages != nil {
+		description.Pipeline = pipeline(stages)
+	}
+	if jobOptions != nil {
+		options := *jobOptions
+		if err := options.Validate(); err != nil {
+			return fmt.Errorf("invalid job options: %s", err)
+		}
+	}
+	enc, err := json.Marshal(description)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Println(string(enc))
+	return err
+}
+
+func (w *Worker) runPipeline(stages []Stage) error {
+	if err := w.start(); err != nil {
+		return err
+	}
+	if err := validatePipeline(stages); err != nil {
+		return fmt.Errorf("invalid pipeline: %s", err)
+	}
+
+	var stage *Stage
+	for i := range stages {
+		if stages[i].Name == w.task.Stage {
+			stage = &stages[i]
+		}
+	}
+	if stage == nil {
+		return fmt.Errorf("unknown stage: %s", w.task.Stage)
+	}
+
+	if err := w.runStage(stage.Name+"_out_", stage.Process, 0); err != nil {
+		return err
+	}
+	return w.finish()
+}
+
+// RunPipeline runs a task of a pipeline job.  The stage of the task is
+// looked up by name in stages, which must be listed in the order of the
+// pipeline.  Like Run, it reports the error which stops the task, including
+// an invalid pipeline, to the master and returns it.
+func (w *Worker) RunPipeline(stages []Stage) error {
+	defer func() { running = nil }()
+	return w.report(w.runPipeline(stages))
+}
+
+// ServePipeline runs a task of a pipeline job over conn, writing the outputs
+// in the current directory.
+func ServePipeline(conn *Conn, stages []Stage) error {
+	return NewWorker(conn, "").RunPipeline(stages)
+}
+
+// RunPipeline runs a task of a pipeline job over the standard input and
+// output, as started by Disco.  Started with the -describe flag, it prints
+// the description of the pipeline and the job options instead.
+func RunPipeline(stages []Stage) {
+	if len(os.Args) > 1 && os.Args[1] == DESCRIBE_FLAG {
+		err := validatePipeline(stages)
+		if err == nil {
+			err = describe(stages)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exit(1)
+		}
+		return
+	}
+	if err := ServePipeline(NewConn(os.Stdin, os.Stdout), stages); err != nil {
+		exit(1)
+	}
+}
@@ -0,0 +1,65 @@
+package worker
+
+import (
+	"encoding/json"
+	"io"
+	"testing"
+)
+
+func nop(io.Reader, io.Writer) {}
+
+func TestPipeline(t *testing.T) {
+	stages := []Stage{
+		{Name: "map", Grouping: Split, Process: nop},
+		{Name: "reduce", Grouping: GroupLabel, Concurrent: true, Process: nop},
+	}
+	if err := validatePipeline(stages); err != nil {
+		t.Fatal("valid pipeline rejected", err)
+	}
+	enc, _ := json.Marshal(pipeline(stages))
+	if string(enc) != `[["map","split",false],["reduce","group_label",true]]` {
+		t.Error("wrong pipeline", string(enc))
+	}
+}
+
+func TestInvalidPipeline(t *testing.T) {
+	pipelines := [][]Stage{
+		{},
+		{{Name: "map", Grouping: "group_everything", Process: nop}},
+		{{Name: "map", Grouping: Split}},
+		{{Name: "map", Grouping: Split, Process: nop}, {Name: "map", Grouping: GroupAll, Process: nop}},
+	}
+	for _, stages := range pipelines {
+		if err := validatePipeline(stages); err == nil {
+			t.Error("invalid pipeline accepted", stages)
+		}
+	}
+}
+
+func TestTaskGroup(t *testing.T) {
+	input := []byte(`{"host":"localhost","stage":"reduce","grouping":"group_label","group":[3,""],"taskid":2}`)
+	var task Task
+	if err := json.Unmarshal(input, &task); err != nil {
+		t.Fatal(err)
+	}
+	if task.Group.Label != 3 || task.Group.Host != "" || task.Taskid != 2 {
+		t.Error("bad task", task)
+	}
+	if task.label() != 3 {
+		t.Error("wrong label", task.label())
+	}
+}
+
+func TestTaskGroupAll(t *testing.T) {
+	input := []byte(`{"stage":"reduce","grouping":"group_node","group":["all","node1"]}`)
+	var task Task
+	if err := json.Unmarshal(input, &task); err != nil {
+		t.Fatal(err)
+	}
+	if task.Group.Label != ALL_LABELS || task.Group.Host != "node1" {
+		t.Error("bad group", task.Group)
+	}
+	if task.label() != ALL_LABELS {
+		t.Error("wrong label", task.label())
+	}
+}
@@ -0,0 +1,274 @@
+package worker
+
+import (
+	"bufio"
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/discoproject/goworker/jobutil"
+)
+
+// MAX_RECORD_SIZE is the longest record read by MapRecords and
+// ReduceRecords.
+const MAX_RECORD_SIZE = 16 * 1024 * 1024
+
+// Codec serializes the keys and values of the records.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+type textCodec struct{}
+
+// TextCodec writes strings and byte slices as they are, the values which
+// implement encoding.TextMarshaler with MarshalText, and the other values
+// with fmt.  It reads strings, byte slices, encoding.TextUnmarshaler and the
+// values fmt.Sscan can read, like numbers.
+var TextCodec Codec = textCodec{}
+
+func (textCodec) Marshal(v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case string:
+		return []byte(v), nil
+	case []byte:
+		return v, nil
+	case encoding.TextMarshaler:
+		return v.MarshalText()
+	}
+	return []byte(fmt.Sprint(v)), nil
+}
+
+func (textCodec) Unmarshal(data []byte, v interface{}) error {
+	switch v := v.(type) {
+	case *string:
+		*v = string(data)
+		return nil
+	case *[]byte:
+		*v = append([]byte(nil), data...)
+		return nil
+	case encoding.TextUnmarshaler:
+		return v.UnmarshalText(data)
+	}
+	_, err := fmt.Sscan(string(data), v)
+	return err
+}
+
+type jsonCodec struct{}
+
+// JSONCodec serializes the keys and values in JSON.
+var JSONCodec Codec = jsonCodec{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// The records are written one per line as the escaped key and value
+// separated by a tab.  The escaped keys contain no whitespace, so the key is
+// the first field of the line, which is what the partitioning of Writer and
+// jobutil.Sorted use.
+var escaper = map[byte]byte{'\\': '\\', '\t': 't', '\n': 'n', '\r': 'r', ' ': 's'}
+var unescaper = map[byte]byte{'\\': '\\', 't': '\t', 'n': '\n', 'r': '\r', 's': ' '}
+
+func escape(data []byte) []byte {
+	result := make([]byte, 0, len(data))
+	for _, c := range data {
+		if e, ok := escaper[c]; ok {
+			result = append(result, '\\', e)
+		} else {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+func unescape(data []byte) ([]byte, error) {
+	result := make([]byte, 0, len(data))
+	for i := 0; i < len(data); i++ {
+		if data[i] != '\\' {
+			result = append(result, data[i])
+			continue
+		}
+		i++
+		if i == len(data) {
+			return nil, fmt.Errorf("bad escape at the end of %q", data)
+		}
+		c, ok := unescaper[data[i]]
+		if !ok {
+			return nil, fmt.Errorf("bad escape \\%c in %q", data[i], data)
+		}
+		result = append(result, c)
+	}
+	return result, nil
+}
+
+// splitRecord returns the escaped key and value of a line.
+func splitRecord(line []byte) ([]byte, []byte, error) {
+	index := bytes.IndexByte(line, '\t')
+	if index == -1 {
+		return nil, nil, fmt.Errorf("record without a value: %q", line)
+	}
+	return line[:index], line[index+1:], nil
+}
+
+// Emitter writes the records of a MapFunc or ReduceFunc.
+type Emitter struct {
+	writer io.Writer
+	codec  Codec
+}
+
+// NewEmitter returns an emitter which writes the records serialized with
+// codec to writer.
+func NewEmitter(writer io.Writer, codec Codec) *Emitter {
+	return &Emitter{writer, codec}
+}
+
+// Emit writes a record.  When the writer is the Writer of the task, the
+// record goes to the partition of its key.
+func (e *Emitter) Emit(key interface{}, value interface{}) error {
+	k, err := e.codec.Marshal(key)
+	if err != nil {
+		return fmt.Errorf("could not encode key %v: %s", key, err)
+	}
+	v, err := e.codec.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("could not encode value %v: %s", value, err)
+	}
+	line := append(append(escape(k), '\t'), escape(v)...)
+	_, err = e.writer.Write(append(line, '\n'))
+	return err
+}
+
+// Key is the key of the values given to a ReduceFunc.
+type Key struct {
+	data  []byte
+	codec Codec
+}
+
+// Decode decodes the key into v.
+func (k Key) Decode(v interface{}) error {
+	return k.codec.Unmarshal(k.data, v)
+}
+
+// String returns the serialized key.
+func (k Key) String() string {
+	return string(k.data)
+}
+
+// Values iterates over the values of a key:
+//
+//	var count int
+//	for values.Next(&count) {
+//		total += count
+//	}
+//	if err := values.Err(); err != nil {
+//		return err
+//	}
+type Values struct {
+	grouper *jobutil.KeyGrouper
+	codec   Codec
+	err     error
+}
+
+func newValues(reader io.Reader, codec Codec) *Values {
+	return &Values{grouper: jobutil.NewKeyGrouper(reader, splitRecord), codec: codec}
+}
+
+// nextKey skips the values left of the current key and moves to the next
+// one.  It returns false when there are no more keys.
+func (v *Values) nextKey() bool {
+	return v.err == nil && v.grouper.Scan()
+}
+
+func (v *Values) currentKey() (Key, error) {
+	key, err := unescape(v.grouper.Key())
+	return Key{key, v.codec}, err
+}
+
+// Next decodes the next value of the key into value, unless value is nil.
+// It returns false when there are no more values or on an error.
+func (v *Values) Next(value interface{}) bool {
+	if v.err != nil || !v.grouper.Next() {
+		return false
+	}
+	data, err := unescape(v.grouper.Value())
+	if err == nil && value != nil {
+		err = v.codec.Unmarshal(data, value)
+	}
+	if err != nil {
+		v.err = fmt.Errorf("could not decode a value of %s: %s", v.grouper.Key(), err)
+		return false
+	}
+	return true
+}
+
+// Err returns the first error met reading or decoding the values.
+func (v *Values) Err() error {
+	if v.err != nil {
+		return v.err
+	}
+	return v.grouper.Err()
+}
+
+// MapFunc processes a record of the input, which is a line without its
+// newline, and emits records with out.
+type MapFunc func(record []byte, out *Emitter) error
+
+// ReduceFunc processes the values of a key and emits records with out.  The
+// values it does not read are skipped.
+type ReduceFunc func(key Key, values *Values, out *Emitter) error
+
+// MapRecords returns a Process which calls fn for every line of its input
+// and writes the records it emits serialized with codec.  An error returned
+// by fn stops the task with Error.
+func MapRecords(fn MapFunc, codec Codec) Process {
+	return func(reader io.Reader, writer io.Writer) {
+		out := NewEmitter(writer, codec)
+		scanner := bufio.NewScanner(reader)
+		scanner.Buffer(make([]byte, 64*1024), MAX_RECORD_SIZE)
+		for scanner.Scan() {
+			if err := fn(scanner.Bytes(), out); err != nil {
+				Error("%s", err)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			Error("could not read the input: %s", err)
+		}
+	}
+}
+
+// ReduceRecords returns a Process which sorts the records of its input,
+// written by MapRecords or ReduceRecords with the same codec, and calls fn
+// once per key with its values.
+func ReduceRecords(fn ReduceFunc, codec Codec) Process {
+	return func(reader io.Reader, writer io.Writer) {
+		sorted, err := jobutil.Sorted(reader)
+		if err != nil {
+			Error("could not sort the input: %s", err)
+		}
+		defer sorted.Close()
+		out := NewEmitter(writer, codec)
+		values := newValues(sorted, codec)
+		for values.nextKey() {
+			key, err := values.currentKey()
+			if err == nil {
+				err = fn(key, values, out)
+			}
+			if err == nil {
+				err = values.Err()
+			}
+			if err != nil {
+				Error("%s", err)
+			}
+		}
+		if err := values.Err(); err != nil {
+			Error("could not read the input: %s", err)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package worker
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/discoproject/goworker/internal/testutil"
+)
+
+func TestEscape(t *testing.T) {
+	for _, s := range []string{"", "a", "a b\tc\nd\re\\", "\\s", "é"} {
+		escaped := escape([]byte(s))
+		if bytes.ContainsAny(escaped, " \t\n\r") {
+			t.Error("whitespace left in", escaped)
+		}
+		unescaped, err := unescape(escaped)
+		if err != nil || string(unescaped) != s {
+			t.Error("wrong unescape", s, string(unescaped), err)
+		}
+	}
+	for _, s := range []string{"\\", "a\\x"} {
+		if _, err := unescape([]byte(s)); err == nil {
+			t.Error("no error for", s)
+		}
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	data, _ := TextCodec.Marshal(42)
+	var n int
+	if err := TextCodec.Unmarshal(data, &n); err != nil || n != 42 {
+		t.Error("wrong int", string(data), n, err)
+	}
+	data, _ = TextCodec.Marshal("a b")
+	var s string
+	if err := TextCodec.Unmarshal(data, &s); err != nil || s != "a b" {
+		t.Error("wrong string", s, err)
+	}
+	data, _ = JSONCodec.Marshal([]int{1, 2})
+	var l []int
+	if err := JSONCodec.Unmarshal(data, &l); err != nil || len(l) != 2 || l[1] != 2 {
+		t.Error("wrong list", l, err)
+	}
+}
+
+func TestEmitter(t *testing.T) {
+	var buf bytes.Buffer
+	out := NewEmitter(&buf, TextCodec)
+	out.Emit("a key", 1)
+	out.Emit("b", "x\ny")
+	if buf.String() != "a\\skey\t1\nb\tx\\ny\n" {
+		t.Errorf("wrong records %q", buf.String())
+	}
+}
+
+func TestValues(t *testing.T) {
+	input := "a\t1\na\t2\nb\t3\nc\t4\nc\t5\n"
+	values := newValues(strings.NewReader(input), TextCodec)
+	var keys []string
+	var sums []int
+	for values.nextKey() {
+		key, _ := values.currentKey()
+		keys = append(keys, key.String())
+		// only read the first value of c
+		sum, n := 0, 0
+		for values.Next(&n) {
+			sum += n
+			if key.String() == "c" {
+				break
+			}
+		}
+		sums = append(sums, sum)
+	}
+	if err := values.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(keys, ",") != "a,b,c" || len(sums) != 3 || sums[0] != 3 || sums[1] != 3 || sums[2] != 4 {
+		t.Error("wrong groups", keys, sums)
+	}
+
+	values = newValues(strings.NewReader("a\tx\n"), TextCodec)
+	values.nextKey()
+	var n int
+	if values.Next(&n) || values.Err() == nil {
+		t.Error("no error for a bad value")
+	}
+	values = newValues(strings.NewReader("a\n"), TextCodec)
+	if values.nextKey() || values.Err() == nil {
+		t.Error("no error for a record without a value")
+	}
+}
+
+func TestRecords(t *testing.T) {
+	dir, names := testutil.TempInputs(t, "the cat\nthe dog\n", "a cat\n")
+	defer os.RemoveAll(dir)
+	Map := MapRecords(func(record []byte, out *Emitter) error {
+		for _, word := range strings.Fields(string(record)) {
+			if err := out.Emit(word, 1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, TextCodec)
+	Reduce := ReduceRecords(func(key Key, values *Values, out *Emitter) error {
+		var word string
+		if err := key.Decode(&word); err != nil {
+			return err
+		}
+		total, count := 0, 0
+		for values.Next(&count) {
+			total += count
+		}
+		return out.Emit(word, total)
+	}, TextCodec)
+
+	job := LocalJob{Inputs: names, Output: filepath.Join(dir, "results"), Partitions: 2}
+	results, err := RunLocal(Map, Reduce, job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[string]string)
+	for _, result := range results {
+		data, _ := ioutil.ReadFile(result)
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			fields := strings.Split(line, "\t")
+			counts[fields[0]] = fields[1]
+		}
+	}
+	if len(counts) != 4 || counts["the"] != "2" || counts["cat"] != "2" || counts["a"] != "1" || counts["dog"] != "1" {
+		t.Error("wrong counts", counts)
+	}
+}
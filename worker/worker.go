@@ -1,148 +1,202 @@
 package worker
 
 import (
-	"bufio"
 	"encoding/json"
 	"fmt"
 	"github.com/discoproject/goworker/jobutil"
 	"io"
-	"io/ioutil"
-	"log"
 	"os"
-	"path/filepath"
 )
 
 const (
 	DEBUG = true
 )
 
+// Check stops the Process function which calls it with err, if it is not
+// nil, like Error: the task fails with a transient error.  It is a
+// convenience for the Process functions, the worker itself reports its
+// errors to Run.
 func Check(err error) {
 	if err != nil {
-		log.Fatal(err)
+		stop(&retryError{err})
 	}
 }
 
 func debug(prefix string, msg interface{}) {
 	if DEBUG {
 		file, err := os.OpenFile("/tmp/debug", os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
-		Check(err)
+		if err != nil {
+			return
+		}
 		defer file.Close()
 		fmt.Fprintf(file, "%s: %v\n", prefix, msg)
 	}
 }
 
-func send(key string, payload interface{}) {
-	enc, err := json.Marshal(payload)
-	if err != nil {
-		panic("could not encode")
-	}
-	str := fmt.Sprintf("%s %d %s\n", key, len(enc), enc)
-	fmt.Printf(str)
-	debug("send", str)
-}
-
-func recv() (string, int, []byte) {
-	var size int
-	var status string
-	fmt.Scanf("%s %d", &status, &size)
-	reader := bufio.NewReader(os.Stdin)
-	input := make([]byte, size)
-	io.ReadFull(reader, input)
-	debug("recv", fmt.Sprintf("%d ", size)+string(input))
-	return status, size, input
-}
-
-func send_worker() {
+func (c *Conn) send_worker() error {
 	type WorkerMsg struct {
 		Pid     int    `json:"pid"`
 		Version string `json:"version"`
 	}
 	wm := WorkerMsg{os.Getpid(), "1.1"}
-	send("WORKER", wm)
+	if err := c.Send("WORKER", wm); err != nil {
+		return err
+	}
 
-	_, _, response := recv()
+	_, response, err := c.Recv()
+	if err != nil {
+		return err
+	}
 	if string(response) != "\"ok\"" {
-		panic(response)
+		return fmt.Errorf("worker rejected by the master: %s", response)
 	}
+	return nil
 }
 
-func request_task() *Task {
+func (c *Conn) request_task() (*Task, error) {
 	task := new(Task)
-	send("TASK", "")
-	_, _, line := recv()
-	json.Unmarshal(line, &task)
+	if err := c.Send("TASK", ""); err != nil {
+		return nil, err
+	}
+	_, line, err := c.Recv()
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(line, &task); err != nil {
+		return nil, fmt.Errorf("bad task %s: %s", line, err)
+	}
 	debug("info", task)
-	return task
+	return task, nil
 }
 
-func request_input() []*Input {
-	send("INPUT", "")
-	_, _, line := recv()
+// request_input asks the master for the inputs of the task.  The inputs whose
+// ids are in exclude have already been consumed and are not sent back.
+func (c *Conn) request_input(exclude []int) (string, []*Input, error) {
+	var err error
+	if len(exclude) == 0 {
+		err = c.Send("INPUT", "")
+	} else {
+		err = c.Send("INPUT", []interface{}{"exclude", exclude})
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	_, line, err := c.Recv()
+	if err != nil {
+		return "", nil, err
+	}
 	return process_input(line)
 }
 
-func process_input(jsonInput []byte) []*Input {
-	var mj []interface{}
-
-	json.Unmarshal(jsonInput, &mj)
-	flag := mj[0].(string)
-	if flag != "done" {
-		// TODO support multiple passes for inputs
-		panic(flag)
+// decode_label decodes a label, which is either a number or "all".
+func decode_label(data []byte) (int, error) {
+	var label interface{}
+	if err := json.Unmarshal(data, &label); err != nil {
+		return 0, err
 	}
-	_inputs := mj[1].([]interface{})
-	result := make([]*Input, len(_inputs))
-	for index, rawInput := range _inputs {
-		inputTuple := rawInput.([]interface{})
+	switch t := label.(type) {
+	case float64:
+		return int(t), nil
+	case string:
+		if t == "all" {
+			return ALL_LABELS, nil
+		}
+	}
+	return 0, fmt.Errorf("bad label: %s", data)
+}
 
-		id := inputTuple[0].(float64)
-		status := inputTuple[1].(string)
+// process_input decodes the reply to an INPUT message.  The returned flag is
+// "done" if the master has sent all the inputs of the task, or "more" if more
+// inputs may become available later.
+func process_input(jsonInput []byte) (string, []*Input, error) {
+	var reply []json.RawMessage
+	var flag string
+	var rawInputs [][]json.RawMessage
 
-		label := -1
-		switch t := inputTuple[2].(type) {
-		case string:
-			label = -1
-		case float64:
-			label = int(t)
+	if err := json.Unmarshal(jsonInput, &reply); err != nil || len(reply) != 2 {
+		return "", nil, fmt.Errorf("bad input reply: %s", jsonInput)
+	}
+	if err := json.Unmarshal(reply[0], &flag); err != nil || (flag != "done" && flag != "more") {
+		return "", nil, fmt.Errorf("bad input flag: %s", reply[0])
+	}
+	if err := json.Unmarshal(reply[1], &rawInputs); err != nil {
+		return "", nil, fmt.Errorf("bad inputs: %s", reply[1])
+	}
+	result := make([]*Input, len(rawInputs))
+	for index, inputTuple := range rawInputs {
+		if len(inputTuple) != 4 {
+			return "", nil, fmt.Errorf("bad input: %v", inputTuple)
 		}
-		_replicas := inputTuple[3].([]interface{})
-
-		replicas := _replicas[0].([]interface{})
+		input := new(Input)
+		if err := json.Unmarshal(inputTuple[0], &input.id); err != nil {
+			return "", nil, fmt.Errorf("bad input id: %s", inputTuple[0])
+		}
+		if err := json.Unmarshal(inputTuple[1], &input.status); err != nil {
+			return "", nil, fmt.Errorf("bad input status: %s", inputTuple[1])
+		}
+		var err error
+		if input.label, err = decode_label(inputTuple[2]); err != nil {
+			return "", nil, err
+		}
+		if input.replicas, err = process_replicas(inputTuple[3]); err != nil {
+			return "", nil, err
+		}
+		if len(input.replicas) == 0 {
+			return "", nil, fmt.Errorf("input without replicas: %d", input.id)
+		}
+		input.replica_id = input.replicas[0].id
+		input.replica_location = input.replicas[0].location
 
-		//FIXME avoid conversion to float when reading the item
-		replica_id := replicas[0].(float64)
-		replica_location := replicas[1].(string)
+		debug("info", fmt.Sprintln(input.id, input.status, input.label, input.replica_id, input.replica_location))
+		result[index] = input
+	}
+	return flag, result, nil
+}
 
-		debug("info", fmt.Sprintln(id, status, label, replica_id, replica_location))
+// process_replicas decodes a list of [replica_id, replica_location] pairs.
+func process_replicas(data []byte) ([]*Replica, error) {
+	var rawReplicas [][]json.RawMessage
+	if err := json.Unmarshal(data, &rawReplicas); err != nil {
+		return nil, fmt.Errorf("bad replicas: %s", data)
+	}
+	replicas := make([]*Replica, len(rawReplicas))
+	for i, replicaTuple := range rawReplicas {
+		replicas[i] = new(Replica)
+		if len(replicaTuple) != 2 ||
+			json.Unmarshal(replicaTuple[0], &replicas[i].id) != nil ||
+			json.Unmarshal(replicaTuple[1], &replicas[i].location) != nil {
+			return nil, fmt.Errorf("bad replica: %v", replicaTuple)
+		}
+	}
+	return replicas, nil
+}
 
-		input := new(Input)
-		input.id = int(id)
-		input.status = status
-		input.label = label
-		input.replica_id = int(replica_id)
-		input.replica_location = replica_location
-		result[index] = input
+// send_input_err informs the master that none of the given replicas of an
+// input could be read.  The master replies with RETRY and a new list of
+// replicas, WAIT and a number of seconds, or FAIL.
+func (c *Conn) send_input_err(id int, failed []int) (string, []byte, error) {
+	if err := c.Send("INPUT_ERR", []interface{}{id, failed}); err != nil {
+		return "", nil, err
 	}
-	return result
+	return c.Recv()
 }
 
-func send_output(outputs []*Output) {
+func (c *Conn) send_output(outputs []*Output) error {
 	for _, output := range outputs {
 		v := make([]interface{}, 3)
 		v[0] = output.label
 		v[1] = output.output_location //"http://example.com"
 		v[2] = output.output_size
 
-		send("OUTPUT", v)
-		_, _, line := recv()
-		debug("info", string(line))
+		if err := c.request("OUTPUT", v); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
-func request_done() {
-	send("DONE", "")
-	_, _, line := recv()
-	debug("info", string(line))
+func (c *Conn) request_done() error {
+	return c.request("DONE", "")
 }
 
 type Task struct {
@@ -151,8 +205,8 @@ type Task struct {
 	Jobname    string
 	Taskid     int
 	Stage      string
-	Grouping   string
-	Group      string
+	Grouping   Grouping
+	Group      Group
 	Disco_port int
 	Put_port   int
 	Disco_data string
@@ -160,10 +214,18 @@ type Task struct {
 	Jobfile    string
 }
 
+type Replica struct {
+	id       int
+	location string
+}
+
+// Input is an input of the task.  replica_id and replica_location refer to
+// the replica which is being read, the first one unless it failed.
 type Input struct {
 	id               int
 	status           string
 	label            int
+	replicas         []*Replica
 	replica_id       int
 	replica_location string
 }
@@ -174,76 +236,184 @@ type Output struct {
 	output_size     int64
 }
 
+// running is the worker running a task.
+var running *Worker
+
+// CurrentTask returns the task run by the worker, which lets the Process
+// functions know about their stage and group.
+func CurrentTask() *Task {
+	if running == nil {
+		return nil
+	}
+	return running.task
+}
+
+// Worker runs a task for the master.  Its outputs are written in dir.
 type Worker struct {
+	conn    *Conn
+	dir     string
 	task    *Task
-	inputs  []*Input
+	inputs  *inputStream
 	outputs []*Output
 }
 
 type Process func(io.Reader, io.Writer)
 
-func (w *Worker) runStage(pwd string, prefix string, process Process) {
-	output, err := ioutil.TempFile(pwd, prefix)
-	output_name := output.Name()
-	Check(err)
-	defer output.Close()
-	locations := make([]string, len(w.inputs))
-	for i, input := range w.inputs {
-		locations[i] = input.replica_location
+// runStage runs process over the inputs of the task.  partitions is the
+// number of partitions of a map stage, 0 for the other stages, see
+// newStageWriter.
+func (w *Worker) runStage(prefix string, process Process, partitions int) error {
+	output := newStageWriter(w.dir, prefix, partitions)
+	if label := w.task.label(); label != ALL_LABELS {
+		output.label = label
+	}
+	if err := safeProcess(process, w.inputs, output); err != nil {
+		output.Close()
+		return err
+	}
+	w.inputs.Close()
+	if w.inputs.err != nil {
+		output.Close()
+		return w.inputs.err
+	}
+	if err := output.Flush(); err != nil {
+		output.Close()
+		return err
 	}
 
-	readCloser := jobutil.AddressReader(locations, jobutil.Setting("DISCO_DATA"))
-	process(readCloser, output)
-	readCloser.Close()
-
-	fileinfo, err := output.Stat()
-	Check(err)
-
-	w.outputs = make([]*Output, 1)
-	w.outputs[0] = new(Output)
+	if len(output.files) == 0 {
+		if _, err := output.file(output.label); err != nil {
+			return &retryError{err}
+		}
+	}
+	if err := output.Close(); err != nil {
+		return &retryError{err}
+	}
 
-	absDiscoPath, err := filepath.EvalSymlinks(w.task.Disco_data)
-	Check(err)
-	w.outputs[0].output_location =
-		"disco://" + jobutil.Setting("HOST") + "/disco/" + output_name[len(absDiscoPath)+1:]
-	w.outputs[0].output_size = fileinfo.Size()
+	var err error
+	w.outputs, err = output.outputs(w.task.Disco_data)
+	return err
 }
 
-func Run(Map Process, Reduce Process) {
-	var w Worker
-	send_worker()
-	w.task = request_task()
+// start introduces the worker to the master and requests the task.
+func (w *Worker) start() error {
+	var err error
+	if w.dir == "" {
+		if w.dir, err = os.Getwd(); err != nil {
+			return err
+		}
+	}
+	if err = w.conn.send_worker(); err != nil {
+		return err
+	}
+	if w.task, err = w.conn.request_task(); err != nil {
+		return err
+	}
 
 	jobutil.SetKeyValue("HOST", w.task.Host)
 	master, port := jobutil.HostAndPort(w.task.Master)
 	jobutil.SetKeyValue("DISCO_MASTER_HOST", master)
 	if port != fmt.Sprintf("%d", w.task.Disco_port) {
-		panic("port mismatch: " + port)
+		return fmt.Errorf("port mismatch: %s", port)
 	}
 	jobutil.SetKeyValue("DISCO_PORT", port)
-	jobutil.SetKeyValue("PUT_PORT", string(w.task.Put_port))
+	jobutil.SetKeyValue("PUT_PORT", fmt.Sprintf("%d", w.task.Put_port))
 	jobutil.SetKeyValue("DISCO_DATA", w.task.Disco_data)
 	jobutil.SetKeyValue("DDFS_DATA", w.task.Ddfs_data)
 
-	w.inputs = request_input()
+	w.inputs = newInputStream(w.conn, jobutil.Setting("DISCO_DATA"))
+	w.inputs.label = w.task.label()
+	running = w
+	return nil
+}
 
-	pwd, err := os.Getwd()
-	Check(err)
+// finish reports the outputs of the task and tells the master it is done.
+func (w *Worker) finish() error {
+	if err := w.conn.send_output(w.outputs); err != nil {
+		return err
+	}
+	return w.conn.request_done()
+}
+
+func (w *Worker) runMapReduce(Map Process, Reduce Process) error {
+	if err := w.start(); err != nil {
+		return err
+	}
 
+	var err error
 	if w.task.Stage == "map" {
-		w.runStage(pwd, "map_out_", Map)
+		// the labels of the outputs depend on the number of reduces
+		var jobdict map[string]interface{}
+		if jobdict, err = read_jobdict(w.task.Jobfile); err != nil {
+			return &retryError{fmt.Errorf("could not read the jobdict: %s", err)}
+		}
+		err = w.runStage("map_out_", Map, partitions(jobdict))
 	} else if w.task.Stage == "map_shuffle" {
-		w.outputs = make([]*Output, len(w.inputs))
-		for i, input := range w.inputs {
+		inputs, err := w.inputs.all()
+		if err != nil {
+			return &retryError{err}
+		}
+		w.outputs = make([]*Output, len(inputs))
+		for i, input := range inputs {
 			w.outputs[i] = new(Output)
 			w.outputs[i].output_location = input.replica_location
 			w.outputs[i].label = input.label
 			w.outputs[i].output_size = 0 // TODO find a way to calculate the size
 		}
 	} else {
-		w.runStage(pwd, "reduce_out_", Reduce)
+		err = w.runStage("reduce_out_", Reduce, 0)
 	}
+	if err != nil {
+		return err
+	}
+
+	return w.finish()
+}
+
+// NewWorker returns a worker which talks to the master over conn and writes
+// its outputs in dir, the current directory if dir is empty.  dir has to be
+// within the disco data directory of the task.
+func NewWorker(conn *Conn, dir string) *Worker {
+	return &Worker{conn: conn, dir: dir}
+}
 
-	send_output(w.outputs)
-	request_done()
+// Run runs a task of a map/reduce job with the given map and reduce
+// functions.  An error which stops the task is reported to the master with
+// ERROR if the task can be retried and FATAL otherwise, and returned.
+func (w *Worker) Run(Map Process, Reduce Process) error {
+	defer func() { running = nil }()
+	return w.report(w.runMapReduce(Map, Reduce))
+}
+
+// Serve runs a task of a map/reduce job over conn, writing the outputs in
+// the current directory.
+func Serve(conn *Conn, Map Process, Reduce Process) error {
+	return NewWorker(conn, "").Run(Map, Reduce)
+}
+
+// Run runs a task of a map/reduce job over the standard input and output,
+// as started by Disco.  It is the only place where the worker exits on an
+// error.
+//
+// Started with the -local flag, it runs the whole job locally with RunLocal
+// instead, on the inputs given as arguments.  Started with the -describe
+// flag, it prints the job options declared with SetJobOptions.
+func Run(Map Process, Reduce Process) {
+	if len(os.Args) > 1 && os.Args[1] == DESCRIBE_FLAG {
+		if err := describe(nil); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == LOCAL_FLAG {
+		if err := runLocal(Map, Reduce, os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exit(1)
+		}
+		return
+	}
+	if err := Serve(NewConn(os.Stdin, os.Stdout), Map, Reduce); err != nil {
+		exit(1)
+	}
 }
@@ -1,13 +1,18 @@
 package worker
 
 import (
+	"bytes"
 	"fmt"
+	"strings"
 	"testing"
 )
 
 func TestInputs(t *testing.T) {
 	input := []byte(`["done",[[0,"ok",0,[[0,"disco://localhost/ddfs/vol0/blob/b"]]]]]`)
-	inputs := process_input(input)
+	_, inputs, err := process_input(input)
+	if err != nil {
+		t.Fatal(err)
+	}
 	if inputs[0].replica_location != "disco://localhost/ddfs/vol0/blob/b" {
 		t.Error("bad input", inputs[0])
 	}
@@ -15,7 +20,10 @@ func TestInputs(t *testing.T) {
 
 func TestInputsTwo(t *testing.T) {
 	input := []byte(`["done",[[0,"ok",0,[[0,"disco://0"]]],[1,"ok",0,[[0,"disco://1"]]]]]`)
-	inputs := process_input(input)
+	_, inputs, err := process_input(input)
+	if err != nil {
+		t.Fatal(err)
+	}
 	if len(inputs) != 2 {
 		t.Error("wrong number of inputs", len(inputs))
 	}
@@ -29,7 +37,10 @@ func TestInputsTwo(t *testing.T) {
 
 func TestInputsMulti(t *testing.T) {
 	input := []byte(`["done",[[0,"ok",0,[[0,"disco://0"]]],[1,"ok",0,[[0,"disco://1"]]],[2,"ok",0,[[0,"disco://2"]]],[3,"ok",0,[[0,"disco://3"]]],[4,"ok",0,[[0,"disco://4"]]]]]`)
-	inputs := process_input(input)
+	_, inputs, err := process_input(input)
+	if err != nil {
+		t.Fatal(err)
+	}
 	if len(inputs) != 5 {
 		t.Error("wrong number of inputs", len(inputs))
 	}
@@ -39,3 +50,68 @@ func TestInputsMulti(t *testing.T) {
 		}
 	}
 }
+
+func TestInputsMore(t *testing.T) {
+	input := []byte(`["more",[[0,"ok",0,[[0,"disco://0"]]],[1,"busy",0,[[0,"disco://1"]]]]]`)
+	flag, inputs, err := process_input(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flag != "more" {
+		t.Error("wrong flag", flag)
+	}
+	if len(inputs) != 2 {
+		t.Error("wrong number of inputs", len(inputs))
+	}
+	if inputs[1].status != "busy" {
+		t.Error("bad status", inputs[1])
+	}
+}
+
+func TestInputsReplicas(t *testing.T) {
+	input := []byte(`["done",[[0,"ok",0,[[3,"disco://a"],[4,"http://b"]]]]]`)
+	_, inputs, err := process_input(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inputs[0].replicas) != 2 {
+		t.Fatal("wrong number of replicas", len(inputs[0].replicas))
+	}
+	if inputs[0].replicas[1].id != 4 || inputs[0].replicas[1].location != "http://b" {
+		t.Error("bad replica", inputs[0].replicas[1])
+	}
+	if inputs[0].replica_id != 3 {
+		t.Error("bad current replica", inputs[0].replica_id)
+	}
+}
+
+func TestInputsBad(t *testing.T) {
+	inputs := []string{
+		``,
+		`["later",[]]`,
+		`["done",[[0,"ok",0]]]`,
+		`["done",[[0,"ok","some",[[0,"disco://0"]]]]]`,
+		`["done",[[0,"ok",0,[]]]]`,
+		`["done",[[0,"ok",0,[[0]]]]]`,
+	}
+	for _, input := range inputs {
+		if _, _, err := process_input([]byte(input)); err == nil {
+			t.Error("no error for", input)
+		}
+	}
+}
+
+func TestMapWithoutJobDict(t *testing.T) {
+	task := `{"host":"localhost","master":"http://localhost:8989","jobname":"a@1","taskid":0,` +
+		`"stage":"map","grouping":"split","group":["all",""],"disco_port":8989,"put_port":8990,` +
+		`"disco_data":"/tmp","ddfs_data":"/tmp","jobfile":"/nonexistent/jobfile"}`
+	replies := "OK 4 \"ok\"\n" + fmt.Sprintf("TASK %d %s\n", len(task), task) + "OK 4 \"ok\"\n"
+	var out bytes.Buffer
+	w := NewWorker(NewConn(strings.NewReader(replies), &out), "/tmp")
+	if err := w.Run(nil, nil); err == nil {
+		t.Fatal("no error without a jobdict")
+	}
+	if !strings.Contains(out.String(), "ERROR ") || !strings.Contains(out.String(), "could not read the jobdict") {
+		t.Error("jobdict error not reported", out.String())
+	}
+}
@@ -0,0 +1,360 @@
+// Package workertest provides a fake Disco master which runs worker tasks in
+// the same process, so that map and reduce functions and the worker protocol
+// can be tested without a Disco cluster.
+//
+//	m := &workertest.Master{Stage: "map", Inputs: []workertest.Input{{Replicas: []string{"input.txt"}}}}
+//	if err := m.Run(Map, Reduce); err != nil {
+//		t.Fatal(err)
+//	}
+//	// m.Outputs[0].Data holds what Map wrote.
+package workertest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/discoproject/goworker/jobpack"
+	"github.com/discoproject/goworker/jobutil"
+	"github.com/discoproject/goworker/worker"
+)
+
+const (
+	HOST       = "localhost"
+	DISCO_PORT = 8989
+	PUT_PORT   = 8990
+)
+
+// Input is an input of the task.
+type Input struct {
+	// Label is the label of the input, or worker.ALL_LABELS.
+	Label int
+	// Replicas are the locations of the replicas of the input.  Local files
+	// are given by their path, the other locations are passed as they are.
+	Replicas []string
+	// Round is the number of INPUT requests the worker has to send before
+	// the input is available.  While some inputs are not available, the
+	// master replies with "more" instead of "done".
+	Round int
+}
+
+// Output is an output reported by the worker.
+type Output struct {
+	Label    int
+	Location string
+	Size     int64
+	// Data is the content of the output, decompressed, when it was written
+	// locally.
+	Data []byte
+}
+
+// Message is a message received from the worker.
+type Message struct {
+	Name    string
+	Payload string
+}
+
+// Master plays the master side of the worker protocol for a single task.
+// The fields before Outputs describe the task, the other ones are filled in
+// by Run and RunPipeline.
+type Master struct {
+	Stage    string
+	Grouping worker.Grouping
+	Group    worker.Group
+	Inputs   []Input
+	// Partitions is the number of reduces of the job, which is the number of
+	// partitions of the map outputs.
+	Partitions int
+	// InputErr returns the reply to an INPUT_ERR message and its payload.
+	// When it is nil, the master replies with FAIL.
+	InputErr func(id int, failed []int) (string, interface{})
+
+	Outputs  []Output
+	Messages []Message
+	// Done is true if the worker sent DONE.
+	Done bool
+
+	dataDir string
+	rounds  int
+}
+
+// Run runs the task with the map and reduce functions of a map/reduce job.
+// It returns the first error of the master, like a protocol error, or the
+// error of the worker.
+func (m *Master) Run(Map worker.Process, Reduce worker.Process) error {
+	return m.run(func(w *worker.Worker) error {
+		return w.Run(Map, Reduce)
+	})
+}
+
+// RunPipeline runs the task with the stages of a pipeline job.
+func (m *Master) RunPipeline(stages []worker.Stage) error {
+	return m.run(func(w *worker.Worker) error {
+		return w.RunPipeline(stages)
+	})
+}
+
+// Errors returns the payloads of the ERROR and FATAL messages sent by the
+// worker.
+func (m *Master) Errors() []string {
+	errors := make([]string, 0)
+	for _, message := range m.Messages {
+		if message.Name == "ERROR" || message.Name == "FATAL" {
+			errors = append(errors, message.Payload)
+		}
+	}
+	return errors
+}
+
+func (m *Master) run(runWorker func(w *worker.Worker) error) error {
+	dir, err := ioutil.TempDir("", "workertest")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	if m.dataDir, err = filepath.EvalSymlinks(dir); err != nil {
+		return err
+	}
+	taskDir := filepath.Join(m.dataDir, HOST, "task")
+	if err = os.MkdirAll(taskDir, 0755); err != nil {
+		return err
+	}
+	m.Outputs = nil
+	m.Messages = nil
+	m.Done = false
+	m.rounds = 0
+
+	masterReader, workerWriter := io.Pipe()
+	workerReader, masterWriter := io.Pipe()
+	master := worker.NewConn(masterReader, masterWriter)
+
+	var wg sync.WaitGroup
+	var masterErr error
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		masterErr = m.serve(master)
+		// unblock the worker if the master stopped first
+		masterReader.CloseWithError(io.EOF)
+		masterWriter.CloseWithError(io.EOF)
+	}()
+
+	workerErr := runWorker(worker.NewWorker(worker.NewConn(workerReader, workerWriter), taskDir))
+	workerWriter.Close()
+	workerReader.Close()
+	wg.Wait()
+
+	// the worker fails too when the master stops on an error
+	if masterErr != nil {
+		return masterErr
+	}
+	if workerErr != nil {
+		return workerErr
+	}
+	return m.readOutputs()
+}
+
+// serve answers the messages of the worker until it is done or failed.
+func (m *Master) serve(conn *worker.Conn) error {
+	for {
+		name, payload, err := conn.Recv()
+		if err != nil {
+			return err
+		}
+		m.Messages = append(m.Messages, Message{name, string(payload)})
+
+		switch name {
+		case "WORKER":
+			err = conn.Send("OK", "ok")
+		case "TASK":
+			var task map[string]interface{}
+			if task, err = m.task(); err == nil {
+				err = conn.Send("TASK", task)
+			}
+		case "INPUT":
+			var inputs []interface{}
+			if inputs, err = m.inputs(payload); err != nil {
+				return err
+			}
+			err = conn.Send("INPUT", inputs)
+		case "INPUT_ERR":
+			var request []json.RawMessage
+			var id int
+			var failed []int
+			if json.Unmarshal(payload, &request) != nil || len(request) != 2 ||
+				json.Unmarshal(request[0], &id) != nil || json.Unmarshal(request[1], &failed) != nil {
+				return fmt.Errorf("bad INPUT_ERR: %s", payload)
+			}
+			reply, replyPayload := "FAIL", interface{}("")
+			if m.InputErr != nil {
+				reply, replyPayload = m.InputErr(id, failed)
+			}
+			err = conn.Send(reply, replyPayload)
+		case "OUTPUT":
+			var output []json.RawMessage
+			var o Output
+			if json.Unmarshal(payload, &output) != nil || len(output) != 3 ||
+				json.Unmarshal(output[0], &o.Label) != nil ||
+				json.Unmarshal(output[1], &o.Location) != nil ||
+				json.Unmarshal(output[2], &o.Size) != nil {
+				return fmt.Errorf("bad OUTPUT: %s", payload)
+			}
+			m.Outputs = append(m.Outputs, o)
+			err = conn.Send("OK", "ok")
+		case "MSG", "PING":
+			err = conn.Send("OK", "ok")
+		case "DONE":
+			m.Done = true
+			return conn.Send("OK", "ok")
+		case "ERROR", "FATAL":
+			return conn.Send("OK", "ok")
+		default:
+			return fmt.Errorf("unknown message: %s %s", name, payload)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (m *Master) task() (map[string]interface{}, error) {
+	jobfile, err := m.writeJobPack()
+	if err != nil {
+		return nil, err
+	}
+	var label interface{} = m.Group.Label
+	if m.Group.Label == worker.ALL_LABELS {
+		label = "all"
+	}
+	grouping := m.Grouping
+	if grouping == "" {
+		grouping = worker.Split
+	}
+	return map[string]interface{}{
+		"host":       HOST,
+		"master":     fmt.Sprintf("http://%s:%d", HOST, DISCO_PORT),
+		"jobname":    "workertest@0:0:0",
+		"taskid":     0,
+		"stage":      m.Stage,
+		"grouping":   grouping,
+		"group":      []interface{}{label, m.Group.Host},
+		"disco_port": DISCO_PORT,
+		"put_port":   PUT_PORT,
+		"disco_data": m.dataDir,
+		"ddfs_data":  filepath.Join(m.dataDir, "ddfs"),
+		"jobfile":    jobfile,
+	}, nil
+}
+
+// writeJobPack writes a jobpack with the jobdict of the task.
+func (m *Master) writeJobPack() (string, error) {
+	partitions := m.Partitions
+	if partitions < 1 {
+		partitions = 1
+	}
+	jp := &jobpack.JobPack{JobDict: map[string]interface{}{
+		"nr_reduces": partitions,
+		"map?":       true,
+		"reduce?":    true,
+	}}
+
+	name := filepath.Join(m.dataDir, "jobfile")
+	file, err := os.Create(name)
+	if err != nil {
+		return "", err
+	}
+	if err = jp.Encode(file); err != nil {
+		file.Close()
+		return "", err
+	}
+	return name, file.Close()
+}
+
+// location returns the location of an input replica.  Local files are
+// linked in the disco data directory and read as disco:// locations.
+func (m *Master) location(id int, index int, replica string) (string, error) {
+	if strings.Contains(replica, "://") {
+		return replica, nil
+	}
+	path, err := filepath.Abs(replica)
+	if err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("input_%d_%d", id, index)
+	link := filepath.Join(m.dataDir, HOST, name)
+	if err = os.Symlink(path, link); err != nil && !os.IsExist(err) {
+		return "", fmt.Errorf("could not link input %d: %s", id, err)
+	}
+	return "disco://" + HOST + "/disco/" + HOST + "/" + name, nil
+}
+
+// inputs returns the reply to an INPUT request.
+func (m *Master) inputs(request []byte) ([]interface{}, error) {
+	exclude := make(map[int]bool)
+	var r []json.RawMessage
+	var ids []int
+	if json.Unmarshal(request, &r) == nil && len(r) == 2 && json.Unmarshal(r[1], &ids) == nil {
+		for _, id := range ids {
+			exclude[id] = true
+		}
+	}
+
+	flag := "done"
+	inputs := make([]interface{}, 0)
+	for id, input := range m.Inputs {
+		if input.Round > m.rounds {
+			flag = "more"
+			continue
+		}
+		if exclude[id] {
+			continue
+		}
+		replicas := make([]interface{}, len(input.Replicas))
+		for i, replica := range input.Replicas {
+			location, err := m.location(id, i, replica)
+			if err != nil {
+				return nil, err
+			}
+			replicas[i] = []interface{}{i, location}
+		}
+		var label interface{} = input.Label
+		if input.Label == worker.ALL_LABELS {
+			label = "all"
+		}
+		inputs = append(inputs, []interface{}{id, "ok", label, replicas})
+	}
+	m.rounds++
+	return []interface{}{flag, inputs}, nil
+}
+
+// readOutputs reads and decompresses the data of the outputs written in the
+// disco data directory.
+func (m *Master) readOutputs() error {
+	prefix := "disco://" + HOST + "/disco/"
+	for i := range m.Outputs {
+		location := m.Outputs[i].Location
+		if !strings.HasPrefix(location, prefix) {
+			continue
+		}
+		name := filepath.Join(m.dataDir, location[len(prefix):])
+		file, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		rc, err := jobutil.Decompress(file, name)
+		if err != nil {
+			return err
+		}
+		m.Outputs[i].Data, err = ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+package workertest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/discoproject/goworker/internal/testutil"
+	"github.com/discoproject/goworker/jobutil"
+	"github.com/discoproject/goworker/worker"
+)
+
+func Map(reader io.Reader, writer io.Writer) {
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		for _, word := range strings.Fields(scanner.Text()) {
+			writer.Write([]byte(word + "\n"))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		worker.Error("%s", err)
+	}
+}
+
+func Reduce(reader io.Reader, writer io.Writer) {
+	counts := make(map[string]int)
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		counts[scanner.Text()]++
+	}
+	words := make([]string, 0, len(counts))
+	for word := range counts {
+		words = append(words, word)
+	}
+	sort.Strings(words)
+	for _, word := range words {
+		fmt.Fprintf(writer, "%d %s\n", counts[word], word)
+	}
+}
+
+func TestMap(t *testing.T) {
+	dir, names := testutil.TempInputs(t, "a b\n", "c a\n")
+	defer os.RemoveAll(dir)
+	m := &Master{Stage: "map", Inputs: []Input{
+		{Replicas: []string{names[0]}},
+		{Replicas: []string{names[1]}},
+	}}
+	if err := m.Run(Map, Reduce); err != nil {
+		t.Fatal(err)
+	}
+	if !m.Done {
+		t.Error("task not done")
+	}
+	if len(m.Outputs) != 1 || m.Outputs[0].Label != 0 {
+		t.Fatal("wrong outputs", m.Outputs)
+	}
+	if string(m.Outputs[0].Data) != "a\nb\nc\na\n" {
+		t.Error("wrong output", string(m.Outputs[0].Data))
+	}
+	if m.Outputs[0].Size != 8 {
+		t.Error("wrong size", m.Outputs[0].Size)
+	}
+}
+
+func TestMapPartitions(t *testing.T) {
+	dir, names := testutil.TempInputs(t, "a b c d e f a b\n")
+	defer os.RemoveAll(dir)
+	m := &Master{Stage: "map", Partitions: 3, Inputs: []Input{{Replicas: []string{names[0]}}}}
+	if err := m.Run(Map, Reduce); err != nil {
+		t.Fatal(err)
+	}
+	for _, output := range m.Outputs {
+		for _, word := range strings.Fields(string(output.Data)) {
+			if label := worker.HashPartitioner([]byte(word), 3); label != output.Label {
+				t.Error("word in the wrong partition", word, output.Label)
+			}
+		}
+	}
+}
+
+func TestMapWrongLabel(t *testing.T) {
+	dir, names := testutil.TempInputs(t, "a\n")
+	defer os.RemoveAll(dir)
+	m := &Master{Stage: "map", Partitions: 2, Inputs: []Input{{Replicas: []string{names[0]}}}}
+	wrong := func(reader io.Reader, writer io.Writer) {
+		// the error is ignored, the task fails anyway
+		writer.(*worker.Writer).Label(2).Write([]byte("a\n"))
+	}
+	if err := m.Run(wrong, Reduce); err == nil {
+		t.Fatal("no error for a label out of the partitions")
+	}
+	if m.Done {
+		t.Error("failed task is done")
+	}
+	if last := m.Messages[len(m.Messages)-1]; last.Name != "FATAL" {
+		t.Error("wrong label not fatal", last)
+	}
+}
+
+func TestReduce(t *testing.T) {
+	dir, names := testutil.TempInputs(t, "a\nb\n", "a\n")
+	defer os.RemoveAll(dir)
+	m := &Master{Stage: "reduce", Grouping: worker.GroupLabel, Group: worker.Group{Label: 2}, Inputs: []Input{
+		{Label: 2, Replicas: []string{names[0]}},
+		{Label: 2, Replicas: []string{names[1]}, Round: 1},
+	}}
+	if err := m.Run(Map, Reduce); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Outputs) != 1 || m.Outputs[0].Label != 2 {
+		t.Fatal("wrong outputs", m.Outputs)
+	}
+	if string(m.Outputs[0].Data) != "2 a\n1 b\n" {
+		t.Error("wrong output", string(m.Outputs[0].Data))
+	}
+}
+
+func TestInputFailover(t *testing.T) {
+	dir, names := testutil.TempInputs(t, "a\n")
+	defer os.RemoveAll(dir)
+	missing := filepath.Join(dir, "missing")
+	var inputErrs [][]int
+	m := &Master{Stage: "map", Inputs: []Input{{Replicas: []string{missing, missing}}}}
+	m.InputErr = func(id int, failed []int) (string, interface{}) {
+		inputErrs = append(inputErrs, failed)
+		location, err := m.location(id, 5, names[0])
+		if err != nil {
+			t.Error(err)
+		}
+		return "RETRY", [][]interface{}{{5, location}}
+	}
+	if err := m.Run(Map, Reduce); err != nil {
+		t.Fatal(err)
+	}
+	if len(inputErrs) != 1 || len(inputErrs[0]) != 2 {
+		t.Error("wrong INPUT_ERR messages", inputErrs)
+	}
+	if string(m.Outputs[0].Data) != "a\n" {
+		t.Error("wrong output", string(m.Outputs[0].Data))
+	}
+}
+
+func TestInputLinkError(t *testing.T) {
+	m := &Master{dataDir: filepath.Join(os.TempDir(), "workertest-missing")}
+	if _, err := m.location(0, 0, "input.txt"); err == nil {
+		t.Error("no error for an input which cannot be linked")
+	}
+}
+
+func TestInputFail(t *testing.T) {
+	dir, _ := testutil.TempInputs(t)
+	defer os.RemoveAll(dir)
+	m := &Master{Stage: "map", Inputs: []Input{{Replicas: []string{filepath.Join(dir, "missing")}}}}
+	if err := m.Run(Map, Reduce); err == nil {
+		t.Fatal("no error for a missing input")
+	}
+	if m.Done {
+		t.Error("failed task is done")
+	}
+	if errors := m.Errors(); len(errors) != 1 || !strings.Contains(errors[0], "cannot read input 0") {
+		t.Error("wrong errors", errors)
+	}
+	if last := m.Messages[len(m.Messages)-1]; last.Name != "ERROR" {
+		t.Error("error not retried", last)
+	}
+}
+
+func TestPanic(t *testing.T) {
+	dir, names := testutil.TempInputs(t, "a\n")
+	defer os.RemoveAll(dir)
+	m := &Master{Stage: "map", Inputs: []Input{{Replicas: []string{names[0]}}}}
+	crash := func(io.Reader, io.Writer) {
+		panic("crash")
+	}
+	if err := m.Run(crash, Reduce); err == nil {
+		t.Fatal("no error for a panic")
+	}
+	if errors := m.Errors(); len(errors) != 1 || !strings.HasPrefix(errors[0], "\"crash\\n") {
+		t.Error("wrong errors", errors)
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	dir, names := testutil.TempInputs(t, "a\nb\n")
+	defer os.RemoveAll(dir)
+	stages := []worker.Stage{
+		{Name: "map", Grouping: worker.Split, Process: Map},
+		{Name: "count", Grouping: worker.GroupAll, Process: func(reader io.Reader, writer io.Writer) {
+			worker.Msg("stage %s", worker.CurrentTask().Stage)
+			Reduce(reader, writer)
+		}},
+	}
+	m := &Master{Stage: "count", Grouping: worker.GroupAll, Inputs: []Input{
+		{Label: worker.ALL_LABELS, Replicas: []string{names[0]}},
+	}}
+	if err := m.RunPipeline(stages); err != nil {
+		t.Fatal(err)
+	}
+	if string(m.Outputs[0].Data) != "1 a\n1 b\n" {
+		t.Error("wrong output", string(m.Outputs[0].Data))
+	}
+	found := false
+	for _, message := range m.Messages {
+		if message.Name == "MSG" && message.Payload == "\"stage count\"" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("message not received", m.Messages)
+	}
+}
+
+func TestUnknownStage(t *testing.T) {
+	m := &Master{Stage: "other"}
+	err := m.RunPipeline([]worker.Stage{{Name: "map", Grouping: worker.Split, Process: Map}})
+	if err == nil {
+		t.Fatal("no error for an unknown stage")
+	}
+	if last := m.Messages[len(m.Messages)-1]; last.Name != "FATAL" {
+		t.Error("unknown stage not fatal", last)
+	}
+}
+
+func TestInvalidPipeline(t *testing.T) {
+	m := &Master{Stage: "map"}
+	err := m.RunPipeline([]worker.Stage{{Name: "map", Grouping: "bad", Process: Map}})
+	if err == nil {
+		t.Fatal("no error for an invalid pipeline")
+	}
+	if last := m.Messages[len(m.Messages)-1]; last.Name != "FATAL" || !strings.Contains(last.Payload, "invalid pipeline") {
+		t.Error("invalid pipeline not reported", last)
+	}
+}
+
+func TestCompressedOutput(t *testing.T) {
+	dir, names := testutil.TempInputs(t, "a b\n")
+	defer os.RemoveAll(dir)
+	m := &Master{Stage: "map", Inputs: []Input{{Replicas: []string{names[0]}}}}
+	if err := m.Run(worker.Compress(Map, jobutil.Gzip), Reduce); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(m.Outputs[0].Location, ".gz") {
+		t.Error("output not compressed", m.Outputs[0].Location)
+	}
+	if string(m.Outputs[0].Data) != "a\nb\n" {
+		t.Error("wrong output", string(m.Outputs[0].Data))
+	}
+}